@@ -2,9 +2,16 @@ package logging
 
 import (
 	"bufio"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
+
+	"gihub.com/scrmbld/OpenWorkbook/cmd/metrics"
 )
 
 // capture the status code from and http.ResponseWriter
@@ -12,6 +19,8 @@ import (
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	// how much of the body has been written
+	bytes int64
 }
 
 func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
@@ -28,11 +37,93 @@ func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lrw.ResponseWriter.WriteHeader(statusCode)
 }
 
-func LogWare(next http.Handler, logger *log.Logger) http.Handler {
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.bytes += int64(n)
+	return n, err
+}
+
+// the header that carries request IDs, in from a proxy that's already given the request
+// one, and back out to the client
+const RequestIDHeader = "X-Request-ID"
+
+// the longest request ID that's taken from a proxy
+const maxRequestID = 64
+
+type loggerKey struct{}
+
+// a new random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the request ID a proxy gave the request, if it's one that's safe to log, otherwise a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestID {
+		return newRequestID()
+	}
+	for _, c := range id {
+		safe := c == '-' || c == '_' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if safe == false {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// the logger for the request that ctx belongs to, which adds its request ID to everything it
+// logs. Outside of a request it's slog's default logger
+func Logger(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if ok == false {
+		return slog.Default()
+	}
+	return logger
+}
+
+// what LogWare counts about the requests it logs
+type Metrics struct {
+	requests *metrics.Counter
+	duration *metrics.Histogram
+}
+
+// request metrics, labelled by the route that handled the request rather than its path, so
+// that there's a series for each route and not each URL
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		requests: reg.Counter("openworkbook_http_requests_total", "HTTP requests handled, by route, method and status code.", "route", "method", "code"),
+		duration: reg.Histogram("openworkbook_http_request_duration_seconds", "How long HTTP requests took, by route. Websockets last as long as their connection.", metrics.DefaultBuckets, "route"),
+	}
+}
+
+// give every request an ID, which handlers can log with through Logger, and log how each
+// request went once it's done. m counts the requests too, unless it's nil
+func LogWare(next http.Handler, logger *slog.Logger, m *Metrics) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// logger.Printf("<-- %s %s", r.Method, r.URL.Path)
-		lrw := loggingResponseWriter{w, 200}
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+		requestLogger := logger.With("request", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, requestLogger))
+
+		start := time.Now()
+		lrw := loggingResponseWriter{ResponseWriter: w, statusCode: 200}
 		next.ServeHTTP(&lrw, r)
-		logger.Printf("%d %s %s", lrw.statusCode, r.Method, r.URL.Path)
+		duration := time.Since(start)
+		if m != nil {
+			// the mux fills in the route it matched, "" if the request never got to it
+			m.requests.Inc(r.Pattern, r.Method, strconv.Itoa(lrw.statusCode))
+			m.duration.Observe(duration.Seconds(), r.Pattern)
+		}
+		requestLogger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", lrw.statusCode,
+			"duration", duration,
+			"bytes", lrw.bytes,
+			"remote", r.RemoteAddr,
+		)
 	})
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -11,28 +14,245 @@ import (
 	"time"
 
 	"gihub.com/scrmbld/OpenWorkbook/cmd/logging"
+	"gihub.com/scrmbld/OpenWorkbook/cmd/metrics"
+	"gihub.com/scrmbld/OpenWorkbook/cmd/procweb"
+	"gihub.com/scrmbld/OpenWorkbook/cmd/ratelimit"
 )
 
 const PORT string = "4400"
 const ADDR string = "0.0.0.0"
 
+// each client's budgets, nil for no limit
+type RateLimits struct {
+	// every HTTP request, pages and static files included
+	Requests *ratelimit.Limiter
+	// programs run, over websockets or the HTTP API
+	Runs *ratelimit.Limiter
+	// who a request comes from
+	Client func(r *http.Request) string
+}
+
 func NewServer(
-	logger *log.Logger,
+	logger *slog.Logger,
+	runner procweb.Runner,
+	limits procweb.LimitPolicy,
+	admission *procweb.Admission,
+	jobs *procweb.BatchJobs,
+	sessions *procweb.SessionStore,
+	hub *procweb.Hub,
+	recorder *procweb.Recorder,
+	rates RateLimits,
+	reg *metrics.Registry,
+	instanceMetrics *procweb.Metrics,
 ) http.Handler {
 	mux := http.NewServeMux()
-	AddRoutes(mux, logger)
+	AddRoutes(mux, logger, runner, limits, admission, jobs, sessions, hub, recorder, rates, reg, instanceMetrics)
 
 	var handler http.Handler = mux
 	// middleware goes here
-	handler = logging.LogWare(handler, logger)
+	handler = ratelimit.LimitWare(handler, rates.Requests, rates.Client)
+	var httpMetrics *logging.Metrics
+	if reg != nil {
+		httpMetrics = logging.NewMetrics(reg)
+	}
+	handler = logging.LogWare(handler, logger, httpMetrics)
 	return handler
 }
 
-func run(ctx context.Context, logger *log.Logger) error {
+// pick the execution backend for code instances by name
+func newRunner(name string, dockerSocket string, pool procweb.PoolConfig, instanceMetrics *procweb.Metrics) (procweb.Runner, error) {
+	switch name {
+	case "docker":
+		docker := procweb.NewDockerRunner(dockerSocket)
+		docker.Metrics = instanceMetrics
+		if pool.Size == 0 && len(pool.Targets) == 0 {
+			return docker, nil
+		}
+		return procweb.NewPoolRunner(docker, pool), nil
+	case "sandbox":
+		return procweb.SandboxRunner{}, nil
+	case "fake":
+		return procweb.FakeRunner{Program: procweb.EchoSourceProgram}, nil
+	default:
+		return nil, fmt.Errorf("unknown runner: %s", name)
+	}
+}
+
+// a logger that writes to w in format, text or json, and leaves out anything below level.
+// Debug logs say where in the code they came from
+func newLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, AddSource: level <= slog.LevelDebug}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+}
+
+// report the stats that the server already keeps as metrics: the queue, the warm container
+// pool and the rate limits
+func addStatsMetrics(reg *metrics.Registry, runner procweb.Runner, admission *procweb.Admission, rates RateLimits) {
+	if admission != nil {
+		reg.GaugeFunc("openworkbook_runs_queued", "Programs waiting for their turn to run.", nil, func() []metrics.Sample {
+			return metrics.Value(float64(admission.Stats().Queued))
+		})
+		reg.GaugeFunc("openworkbook_runs_running", "Programs that have had their turn to run and are still going.", nil, func() []metrics.Sample {
+			return metrics.Value(float64(admission.Stats().Running))
+		})
+	}
+
+	if pool, ok := runner.(*procweb.PoolRunner); ok {
+		poolStat := func(get func(s procweb.PoolStats) float64) func() []metrics.Sample {
+			return func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, s := range pool.Stats() {
+					samples = append(samples, metrics.Sample{Labels: []string{s.Language}, Value: get(s)})
+				}
+				return samples
+			}
+		}
+		language := []string{"language"}
+		reg.GaugeFunc("openworkbook_pool_idle", "Warm containers waiting for a program, by language.", language, poolStat(func(s procweb.PoolStats) float64 { return float64(s.Idle) }))
+		reg.CounterFunc("openworkbook_pool_hits_total", "Programs that got a warm container, by language.", language, poolStat(func(s procweb.PoolStats) float64 { return float64(s.Hits) }))
+		reg.CounterFunc("openworkbook_pool_misses_total", "Programs that had to start their own container, by language.", language, poolStat(func(s procweb.PoolStats) float64 { return float64(s.Misses) }))
+		reg.CounterFunc("openworkbook_pool_failures_total", "Warm containers that failed to start, by language.", language, poolStat(func(s procweb.PoolStats) float64 { return float64(s.Failures) }))
+	}
+
+	limiters := []struct {
+		name    string
+		limiter *ratelimit.Limiter
+	}{{"requests", rates.Requests}, {"runs", rates.Runs}}
+	rateStat := func(get func(s ratelimit.Stats) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, l := range limiters {
+				if l.limiter != nil {
+					samples = append(samples, metrics.Sample{Labels: []string{l.name}, Value: get(l.limiter.Stats())})
+				}
+			}
+			return samples
+		}
+	}
+	limit := []string{"limit"}
+	reg.CounterFunc("openworkbook_ratelimit_allowed_total", "Requests and runs let through by the rate limits, by limit.", limit, rateStat(func(s ratelimit.Stats) float64 { return float64(s.Allowed) }))
+	reg.CounterFunc("openworkbook_ratelimit_rejected_total", "Requests and runs turned away by the rate limits, by limit.", limit, rateStat(func(s ratelimit.Stats) float64 { return float64(s.Rejected) }))
+}
+
+func run(ctx context.Context, args []string) error {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
-	srv := NewServer(logger)
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	runnerName := flags.String("runner", "docker", "execution backend for code instances (docker, sandbox, fake)")
+	dockerSocket := flags.String("docker-socket", procweb.DefaultDockerSocket, "the docker daemon's API socket, for the docker runner")
+	limits := procweb.LimitPolicy{Default: procweb.DefaultLimits, Max: procweb.DefaultLimits}
+	flags.Var(&limits.Default, "limits", "default resource limits for each instance, like wallClock=2s,memory=67108864")
+	flags.Var(&limits.Max, "max-limits", "the most that an exercise can raise each resource limit to, the same as -limits if it isn't given")
+	var pool procweb.PoolConfig
+	flags.IntVar(&pool.Size, "pool-size", 0, "idle containers to keep warm for each language, for the docker runner")
+	flags.Var(&pool.Targets, "pool-targets", "per-language overrides for -pool-size, like python=4,c=0")
+	flags.DurationVar(&pool.MaxAge, "pool-max-age", 10*time.Minute, "replace idle containers older than this")
+	maxRunning := flags.Int("max-running", 0, "the most programs that can run at once, 0 for no cap")
+	maxQueued := flags.Int("max-queued", 100, "the most programs that can wait for a turn to run when -max-running are already running")
+	queueTimeout := flags.Duration("queue-timeout", time.Minute, "how long a program can wait for a turn to run, 0 for forever")
+	requestsPerMinute := flags.Int("requests-per-minute", 600, "the most HTTP requests each client can make a minute, 0 for no limit")
+	runsPerMinute := flags.Int("runs-per-minute", 30, "the most programs each client can run a minute, 0 for no limit")
+	sessions := procweb.NewSessionStore()
+	flags.DurationVar(&sessions.Grace, "resume-grace", procweb.DefaultResumeGrace, "how long a program keeps running for its client to reconnect after the connection drops, 0 to kill it straight away")
+	flags.IntVar(&sessions.ReplayBytes, "replay-buffer", procweb.DefaultReplayBytes, "how much of each program's recent output is kept for clients that reconnect, in bytes")
+	hub := procweb.NewHub()
+	flags.IntVar(&hub.Backlog, "viewer-backlog", procweb.DefaultViewerBacklog, "how many messages a viewer of someone else's program can fall behind by before it's dropped, 0 to turn viewers off")
+	recordDir := flags.String("record-dir", "", "keep a recording of every run in this directory, to replay later. Runs aren't recorded by default")
+	trustProxy := flags.Bool("trust-proxy", false, "tell clients apart by X-Forwarded-For, for running behind a reverse proxy")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "the least important logs to write (debug, info, warn, error)")
+	logFormat := flags.String("log-format", "text", "how logs are written (text, json)")
+	flags.BoolVar(&procweb.LogUserContent, "log-user-content", false, "log the code and input that clients send at debug level, rather than just its size")
+	serveMetrics := flags.Bool("metrics", true, "serve metrics for Prometheus at /metrics")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	// without -max-limits, raising a default with -limits raises its maximum with it
+	maxLimitsSet := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "max-limits" {
+			maxLimitsSet = true
+		}
+	})
+	if maxLimitsSet == false {
+		limits.Max = limits.Default
+	}
+	if err := limits.Check(); err != nil {
+		return err
+	}
+	logger, err := newLogger(os.Stderr, logLevel, *logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	procweb.ProcLog = logger
+
+	var reg *metrics.Registry
+	var instanceMetrics *procweb.Metrics
+	if *serveMetrics {
+		reg = metrics.NewRegistry()
+		instanceMetrics = procweb.NewMetrics(reg)
+	}
+
+	// pooled containers get the limits that most instances will ask for
+	pool.Limits = limits.Default
+	runner, err := newRunner(*runnerName, *dockerSocket, pool, instanceMetrics)
+	if err != nil {
+		return err
+	}
+
+	// clean up after instances that were running when the server last stopped
+	if reaper, ok := runner.(procweb.Reaper); ok {
+		if err := reaper.Reap(ctx); err != nil {
+			logger.Error("failed to remove leftover instances", "err", err)
+		}
+	}
+	if pool, ok := runner.(*procweb.PoolRunner); ok {
+		pool.Start(ctx)
+	}
+
+	var admission *procweb.Admission
+	if *maxRunning != 0 {
+		admission = procweb.NewAdmission(*maxRunning, *maxQueued, *queueTimeout)
+	}
+	rates := RateLimits{
+		Client: func(r *http.Request) string {
+			return ratelimit.ClientIP(r, *trustProxy)
+		},
+	}
+	if *requestsPerMinute != 0 {
+		rates.Requests = ratelimit.NewLimiter(*requestsPerMinute)
+	}
+	if *runsPerMinute != 0 {
+		rates.Runs = ratelimit.NewLimiter(*runsPerMinute)
+	}
+	if sessions.Grace == 0 {
+		sessions = nil
+	}
+	if hub.Backlog == 0 {
+		hub = nil
+	}
+	var recorder *procweb.Recorder
+	if *recordDir != "" {
+		recorder, err = procweb.NewRecorder(*recordDir)
+		if err != nil {
+			return err
+		}
+	}
+	// async batch runs outlive their requests, so they stop with the server instead
+	jobs := procweb.NewBatchJobs(ctx)
+	if reg != nil {
+		addStatsMetrics(reg, runner, admission, rates)
+	}
+	srv := NewServer(logger, runner, limits, admission, jobs, sessions, hub, recorder, rates, reg, instanceMetrics)
 
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(ADDR, PORT),
@@ -40,9 +260,9 @@ func run(ctx context.Context, logger *log.Logger) error {
 	}
 
 	go func() {
-		logger.Printf("listening on %s\n", httpServer.Addr)
+		logger.Info("listening", "addr", httpServer.Addr)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Printf("error listening and serving: %s\n", err)
+			logger.Error("failed to listen and serve", "err", err)
 		}
 	}()
 
@@ -55,7 +275,13 @@ func run(ctx context.Context, logger *log.Logger) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
-			logger.Printf("error shutting down http server")
+			logger.Error("failed to shut down http server", "err", err)
+		}
+		// Shutdown doesn't wait for websockets, so stop their instances ourselves
+		if reaper, ok := runner.(procweb.Reaper); ok {
+			if err := reaper.Close(); err != nil {
+				logger.Error("failed to stop instances", "err", err)
+			}
 		}
 	}()
 
@@ -64,10 +290,9 @@ func run(ctx context.Context, logger *log.Logger) error {
 }
 
 func main() {
-	logger := log.New(os.Stderr, "HTTP: ", log.Ldate|log.Ltime|log.Lmsgprefix)
 	ctx := context.Background()
-	if err := run(ctx, logger); err != nil {
-		logger.Printf("%s\n", err)
+	if err := run(ctx, os.Args); err != nil {
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 }
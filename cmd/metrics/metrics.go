@@ -0,0 +1,344 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a Registry keeps the server's metrics, and writes them out in Prometheus' text
+// exposition format for whatever scrapes them
+type Registry struct {
+	mtx     sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// anything that can write itself out, HELP and TYPE lines included
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// what every metric has: its name, what it's about, and what its samples are labelled with
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// the key of the series with the given label values. It panics if there are the wrong
+// number of them, since that's a mistake in the code rather than anything at runtime
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// write one sample. extra is another label and its value, like a histogram bucket's le
+func (f *family) sample(w *bufio.Writer, suffix string, values []string, extra []string, v float64) {
+	w.WriteString(f.name + suffix)
+	names := f.labels
+	if extra != nil {
+		names = append(slices.Clip(names), extra[0])
+		values = append(slices.Clip(values), extra[1])
+	}
+	if len(names) != 0 {
+		w.WriteByte('{')
+		for i, name := range names {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", name, escapeLabel(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+// add a metric to be written out, after the ones before it
+func (r *Registry) add(m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// write every metric in the text exposition format
+func (r *Registry) Write(w *bufio.Writer) error {
+	r.mtx.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mtx.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// serve the metrics to scrapers
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(bufio.NewWriter(w))
+	})
+}
+
+// counters and gauges
+// =====================================
+
+// a value for each combination of label values, in the order they were first seen
+type values struct {
+	family
+	mtx    sync.Mutex
+	order  []string
+	series map[string]*valueSeries
+}
+
+type valueSeries struct {
+	labels []string
+	value  float64
+}
+
+func newValues(name string, help string, kind string, labels []string) values {
+	return values{family: family{name: name, help: help, kind: kind, labels: labels}, series: make(map[string]*valueSeries)}
+}
+
+// change a series' value with f, starting it at 0 if it's new
+func (v *values) update(labels []string, f func(float64) float64) {
+	key := v.key(labels)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	s, ok := v.series[key]
+	if ok == false {
+		s = &valueSeries{labels: slices.Clone(labels)}
+		v.series[key] = s
+		v.order = append(v.order, key)
+	}
+	s.value = f(s.value)
+}
+
+func (v *values) write(w *bufio.Writer) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.header(w)
+	for _, key := range v.order {
+		s := v.series[key]
+		v.sample(w, "", s.labels, nil, s.value)
+	}
+}
+
+// a Counter only goes up, like how many requests there have been.
+// A nil Counter counts nothing
+type Counter struct {
+	values
+}
+
+// a new counter, whose samples are labelled with labels. Counters' names end in _total
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newValues(name, help, "counter", labels)}
+	r.add(c)
+	return c
+}
+
+// add 1 to the series with the given label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// add v to the series with the given label values. v can't be negative
+func (c *Counter) Add(v float64, labels ...string) {
+	if c == nil {
+		return
+	}
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't go down", c.name))
+	}
+	c.update(labels, func(old float64) float64 { return old + v })
+}
+
+// a Gauge goes up and down, like how many programs are running.
+// A nil Gauge keeps nothing
+type Gauge struct {
+	values
+}
+
+// a new gauge, whose samples are labelled with labels
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newValues(name, help, "gauge", labels)}
+	r.add(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	if g == nil {
+		return
+	}
+	g.update(labels, func(float64) float64 { return v })
+}
+
+// add v to the series with the given label values. v can be negative
+func (g *Gauge) Add(v float64, labels ...string) {
+	if g == nil {
+		return
+	}
+	g.update(labels, func(old float64) float64 { return old + v })
+}
+
+// metrics kept somewhere else
+// =====================================
+
+// a Sample is one value of a metric that's read when the metrics are written
+type Sample struct {
+	// the label values, in the order of the metric's labels
+	Labels []string
+	Value  float64
+}
+
+// a single unlabelled sample
+func Value(v float64) []Sample {
+	return []Sample{{Value: v}}
+}
+
+type funcMetric struct {
+	family
+	collect func() []Sample
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	for _, s := range m.collect() {
+		m.key(s.Labels)
+		m.sample(w, "", s.Labels, nil, s.Value)
+	}
+}
+
+// a counter whose samples come from collect when the metrics are written, for things that
+// already count for themselves
+func (r *Registry) CounterFunc(name string, help string, labels []string, collect func() []Sample) {
+	r.add(&funcMetric{family: family{name: name, help: help, kind: "counter", labels: labels}, collect: collect})
+}
+
+// a gauge whose samples come from collect when the metrics are written
+func (r *Registry) GaugeFunc(name string, help string, labels []string, collect func() []Sample) {
+	r.add(&funcMetric{family: family{name: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+// histograms
+// =====================================
+
+// buckets for how long things take in seconds, from a few milliseconds to ten seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// a Histogram counts observations, like how long requests take, into buckets by how big
+// they are. A nil Histogram observes nothing
+type Histogram struct {
+	family
+	// the upper bound of each bucket, smallest first. There's always a +Inf bucket after them
+	buckets []float64
+
+	mtx    sync.Mutex
+	order  []string
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	// how many observations fell in each bucket, not counting the ones below it
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// a new histogram with the given bucket upper bounds, whose samples are labelled with labels
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &Histogram{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.add(h)
+	return h
+}
+
+// count v in the series with the given label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	if h == nil {
+		return
+	}
+	key := h.key(labels)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.series[key]
+	if ok == false {
+		s = &histogramSeries{labels: slices.Clone(labels), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.order = append(h.order, key)
+	}
+	i, _ := slices.BinarySearch(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.header(w)
+	for _, key := range h.order {
+		s := h.series[key]
+		// buckets are written out cumulative, each counting everything up to its bound
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.sample(w, "_bucket", s.labels, []string{"le", formatFloat(bound)}, float64(cumulative))
+		}
+		h.sample(w, "_bucket", s.labels, []string{"le", "+Inf"}, float64(s.count))
+		h.sample(w, "_sum", s.labels, nil, s.sum)
+		h.sample(w, "_count", s.labels, nil, float64(s.count))
+	}
+}
+
+// formatting
+// =====================================
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, "text/plain") == false {
+		t.Errorf("bad content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests handled.", "method", "code")
+	running := r.Gauge("running", "Programs running.")
+	duration := r.Histogram("duration_seconds", "How long things took.", []float64{1, 0.1})
+	r.GaugeFunc("queued", "Programs waiting.", nil, func() []Sample { return Value(3) })
+
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(2, "POST", `a "quoted"`+"\nvalue")
+	running.Add(2)
+	running.Add(-1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 5} {
+		duration.Observe(v)
+	}
+
+	expected := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="POST",code="a \"quoted\"\nvalue"} 2
+# HELP running Programs running.
+# TYPE running gauge
+running 1
+# HELP duration_seconds How long things took.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 2
+duration_seconds_bucket{le="1"} 3
+duration_seconds_bucket{le="+Inf"} 4
+duration_seconds_sum 5.65
+duration_seconds_count 4
+# HELP queued Programs waiting.
+# TYPE queued gauge
+queued 3
+`
+	if got := scrape(t, r); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	// none of these should panic
+	c.Inc("a")
+	g.Set(1)
+	h.Observe(1)
+}
+
+func TestWrongLabels(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic for the wrong number of label values")
+		}
+	}()
+	NewRegistry().Counter("things_total", "Things.", "kind").Inc()
+}
@@ -0,0 +1,155 @@
+package procweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// admission control
+// =====================================
+
+var (
+	// the queue is full, so the program can't even wait for a turn
+	ErrQueueFull = errors.New("the server is busy running other programs, try again in a little while")
+	// the program waited too long for a turn
+	ErrQueueTimeout = errors.New("the server was too busy to run the program, try again in a little while")
+)
+
+// an Admission caps how many programs run at once. Programs past the cap wait their turn
+// in a queue, first come first served. A nil Admission lets every program run straight away
+type Admission struct {
+	maxRunning int
+	maxQueued  int
+	timeout    time.Duration
+
+	mtx     sync.Mutex
+	running int
+	queue   []*admissionTicket
+}
+
+// a place in the queue, or a turn to run once admitted
+type admissionTicket struct {
+	// closed once it's the program's turn
+	admitted chan struct{}
+	// the ticket's latest position in the queue, counting from 1. Holds at most one
+	position chan int
+	left     bool
+}
+
+// an Admission that runs up to maxRunning programs at once, with up to maxQueued more
+// waiting for at most timeout, or forever if timeout is zero
+func NewAdmission(maxRunning int, maxQueued int, timeout time.Duration) *Admission {
+	return &Admission{maxRunning: maxRunning, maxQueued: maxQueued, timeout: timeout}
+}
+
+// AdmissionStats is a snapshot of an Admission, for monitoring
+type AdmissionStats struct {
+	Running    int `json:"running"`
+	Queued     int `json:"queued"`
+	MaxRunning int `json:"maxRunning"`
+	MaxQueued  int `json:"maxQueued"`
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return AdmissionStats{Running: a.running, Queued: len(a.queue), MaxRunning: a.maxRunning, MaxQueued: a.maxQueued}
+}
+
+// get in line to run a program. The ticket has to be waited on, and left once the program
+// is done
+func (a *Admission) enqueue() (*admissionTicket, error) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	t := &admissionTicket{admitted: make(chan struct{}), position: make(chan int, 1)}
+	if a.running < a.maxRunning && len(a.queue) == 0 {
+		a.running++
+		close(t.admitted)
+		return t, nil
+	}
+	if len(a.queue) >= a.maxQueued {
+		return nil, ErrQueueFull
+	}
+	a.queue = append(a.queue, t)
+	t.setPosition(len(a.queue))
+	return t, nil
+}
+
+// replace the position the waiter hasn't picked up yet. Only call this with the lock held
+func (t *admissionTicket) setPosition(position int) {
+	select {
+	case <-t.position:
+	default:
+	}
+	t.position <- position
+}
+
+// wait for the ticket's turn, calling queued with its position in the queue whenever it
+// changes. The ticket is left if the wait fails
+func (a *Admission) wait(ctx context.Context, t *admissionTicket, queued func(position int)) error {
+	if a == nil {
+		return nil
+	}
+	var timeout <-chan time.Time
+	if a.timeout != 0 {
+		timer := time.NewTimer(a.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-t.admitted:
+			return nil
+		case position := <-t.position:
+			queued(position)
+		case <-timeout:
+			a.leave(t)
+			return fmt.Errorf("%w (waited %s)", ErrQueueTimeout, a.timeout)
+		case <-ctx.Done():
+			a.leave(t)
+			return ctx.Err()
+		}
+	}
+}
+
+// give up the ticket's place in the queue, or its turn to run, letting the next program in.
+// Leaving more than once does nothing
+func (a *Admission) leave(t *admissionTicket) {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if t.left {
+		return
+	}
+	t.left = true
+
+	select {
+	case <-t.admitted:
+		a.running--
+	default:
+		for i, v := range a.queue {
+			if v == t {
+				a.queue = append(a.queue[:i], a.queue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// let the programs at the front of the queue in, and tell the rest they've moved up
+	for a.running < a.maxRunning && len(a.queue) != 0 {
+		a.running++
+		close(a.queue[0].admitted)
+		a.queue = a.queue[1:]
+	}
+	for i, v := range a.queue {
+		v.setPosition(i + 1)
+	}
+}
@@ -0,0 +1,131 @@
+package procweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(1, 2, 0)
+	ctx := context.Background()
+	first, err := a.enqueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.wait(ctx, first, func(int) { t.Errorf("the first program shouldn't wait") }); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := a.enqueue()
+	third, _ := a.enqueue()
+	if _, err := a.enqueue(); errors.Is(err, ErrQueueFull) == false {
+		t.Errorf("expected a full queue, got %v", err)
+	}
+	if stats := a.Stats(); stats.Running != 1 || stats.Queued != 2 {
+		t.Errorf("bad stats %+v", stats)
+	}
+
+	// the third program gives up, and then the first one ends, letting the second in
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := a.wait(cancelled, third, func(int) {}); err == nil {
+		t.Errorf("a cancelled wait succeeded")
+	}
+	a.leave(first)
+	a.leave(first)
+	var positions []int
+	if err := a.wait(ctx, second, func(p int) { positions = append(positions, p) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) > 1 || (len(positions) == 1 && positions[0] != 1) {
+		t.Errorf("bad positions %v", positions)
+	}
+	a.leave(second)
+	if stats := a.Stats(); stats.Running != 0 || stats.Queued != 0 {
+		t.Errorf("expected everything to have left, got %+v", stats)
+	}
+
+	var none *Admission
+	ticket, err := none.enqueue()
+	if err != nil || none.wait(ctx, ticket, nil) != nil {
+		t.Errorf("no admission should let everything in")
+	}
+	none.leave(ticket)
+}
+
+func TestQueuedRun(t *testing.T) {
+	admission := NewAdmission(1, 1, 0)
+	forever := InstanceConfig{Runner: FakeRunner{Program: fakeForever}, Language: Languages["luajit"], Admission: admission}
+	hello := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"], Admission: admission}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running, err := StartRun(ctx, forever, Program{Files: NewWorkspace()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting, err := StartRun(ctx, hello, Program{Files: NewWorkspace()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartRun(ctx, hello, Program{Files: NewWorkspace()}); errors.Is(err, ErrQueueFull) == false {
+		t.Errorf("expected a full queue, got %v", err)
+	}
+
+	msg := <-waiting.Output
+	var queued QueuedMessage
+	if msg.Category != "queued" || json.Unmarshal([]byte(msg.Body), &queued) != nil || queued.Position != 1 {
+		t.Fatalf("expected to be first in line, got %v", msg)
+	}
+	// the waiting program runs once the running one is done
+	running.Signal(syscall.SIGKILL)
+	result := collectBatch(waiting, "")
+	if result.Stdout != "hi\n" || result.Exit.Code != 0 {
+		t.Errorf("bad result %+v", result)
+	}
+	if running := collectBatch(running, ""); running.Exit.Code != 137 {
+		t.Errorf("bad exit %+v", running.Exit)
+	}
+}
+
+// an instance turned away by a full queue is told why, rather than failing
+func TestQueueFullInstance(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"], Admission: NewAdmission(0, 0, 0)}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, []string{ErrBusy}) == false {
+		t.Errorf("expected a busy error, got %v", msgs)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	admission := NewAdmission(1, 1, 50*time.Millisecond)
+	forever := InstanceConfig{Runner: FakeRunner{Program: fakeForever}, Language: Languages["luajit"], Admission: admission}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := StartRun(ctx, forever, Program{Files: NewWorkspace()}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"], Admission: admission}
+	result, err := RunBatch(ctx, config, Program{Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "" || result.Exit.Code != -1 || result.Exit.Description == "" {
+		t.Errorf("expected the program to give up waiting, got %+v", result)
+	}
+	if stats := admission.Stats(); stats.Queued != 0 {
+		t.Errorf("the program didn't leave the queue: %+v", stats)
+	}
+}
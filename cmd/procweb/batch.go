@@ -0,0 +1,181 @@
+package procweb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// running programs without a websocket
+// =====================================
+
+// how long the result of an async batch run is kept after the program ends
+const DefaultBatchRetention = 10 * time.Minute
+
+// a BatchRequest asks for a program to be run with all of its input up front, for scripts,
+// graders and tests that don't want to hold a websocket open
+type BatchRequest struct {
+	// the name of the program's language, like "luajit"
+	Language string `json:"language"`
+	// the language's usual file, like a "code" message
+	Code string `json:"code"`
+	// any number of files, like "file" messages
+	Files []FileMessage `json:"files"`
+	// the file the program starts from, "" for the language's usual file
+	Entrypoint string `json:"entrypoint"`
+	// all of the program's input. Its stdin ends after this
+	Stdin string `json:"stdin"`
+	// limit overrides, like the query of the /echo websocket
+	Limits map[string]string `json:"limits"`
+	// start the program and return its ID straight away, instead of waiting for it to end
+	Async bool `json:"async"`
+}
+
+// the program described by the request, which is written in lang
+func (r BatchRequest) Program(lang Language) (Program, error) {
+	files := NewWorkspace()
+	if r.Code != "" {
+		files.Append(lang.FileName, r.Code)
+	}
+	for _, f := range r.Files {
+		err := files.Append(f.Path, f.Content)
+		if err != nil {
+			return Program{}, err
+		}
+	}
+	if r.Entrypoint != "" {
+		err := validateFilePath(r.Entrypoint)
+		if err != nil {
+			return Program{}, err
+		}
+	}
+	return Program{Files: files, Entrypoint: r.Entrypoint}, nil
+}
+
+// the states of a batch run
+const (
+	BatchRunning = "running"
+	BatchDone    = "done"
+)
+
+// a BatchResult is everything a batch run printed, and how it ended
+type BatchResult struct {
+	// only set for async runs
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// EncodingBase64 if the program's output isn't all UTF-8, in which case Stdout and
+	// Stderr are both base64 encoded. "" for plain text
+	Encoding string `json:"encoding,omitempty"`
+	// nil while the program is running
+	Exit *ExitStatus `json:"exit,omitempty"`
+	// what the run can be replayed with, if it was recorded
+	Recording string `json:"recording,omitempty"`
+}
+
+// feed stdin to the run and collect its output until it ends
+func collectBatch(run *Run, stdin string) BatchResult {
+	go func() {
+		if stdin != "" {
+			select {
+			case <-run.Finished():
+				return
+			case run.Stdin <- []byte(stdin):
+			}
+		}
+		close(run.Stdin)
+	}()
+
+	var stdout, stderr strings.Builder
+	for msg := range run.Output {
+		switch msg.Category {
+		case "stdout":
+			stdout.WriteString(msg.Body)
+		case "stderr":
+			stderr.WriteString(msg.Body)
+		}
+	}
+	status := run.Status()
+	result := BatchResult{Status: BatchDone, Stdout: stdout.String(), Stderr: stderr.String(), Exit: &status, Recording: run.Recording()}
+	if utf8.ValidString(result.Stdout) == false || utf8.ValidString(result.Stderr) == false {
+		result.Stdout = base64.StdEncoding.EncodeToString([]byte(result.Stdout))
+		result.Stderr = base64.StdEncoding.EncodeToString([]byte(result.Stderr))
+		result.Encoding = EncodingBase64
+	}
+	return result
+}
+
+// run program with the given input, and wait for it to end. Cancelling ctx kills it
+func RunBatch(ctx context.Context, config InstanceConfig, program Program, stdin string) (BatchResult, error) {
+	run, err := StartRun(ctx, config, program)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	return collectBatch(run, stdin), nil
+}
+
+// BatchJobs keeps track of async batch runs, so their results can be picked up later
+type BatchJobs struct {
+	// how long results are kept after their program ends. Zero means DefaultBatchRetention
+	Retention time.Duration
+
+	ctx  context.Context
+	mtx  sync.Mutex
+	jobs map[string]*BatchResult
+}
+
+// the runs stop when ctx is cancelled
+func NewBatchJobs(ctx context.Context) *BatchJobs {
+	return &BatchJobs{ctx: ctx, jobs: make(map[string]*BatchResult)}
+}
+
+// start running program in the background, returning the ID to look its result up by
+func (b *BatchJobs) Start(config InstanceConfig, program Program, stdin string) (string, error) {
+	id := newInstanceID()
+	program.ID = id
+	run, err := StartRun(b.ctx, config, program)
+	if err != nil {
+		return "", err
+	}
+	run.log.Info("batch job started")
+
+	b.mtx.Lock()
+	b.jobs[id] = &BatchResult{ID: id, Status: BatchRunning}
+	b.mtx.Unlock()
+
+	go func() {
+		result := collectBatch(run, stdin)
+		result.ID = id
+		b.mtx.Lock()
+		b.jobs[id] = &result
+		b.mtx.Unlock()
+		run.log.Info("batch job done")
+
+		retention := b.Retention
+		if retention == 0 {
+			retention = DefaultBatchRetention
+		}
+		time.AfterFunc(retention, func() {
+			b.mtx.Lock()
+			defer b.mtx.Unlock()
+			delete(b.jobs, id)
+		})
+	}()
+	return id, nil
+}
+
+// the result of the job with the given ID, so far
+func (b *BatchJobs) Get(id string) (BatchResult, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	result, ok := b.jobs[id]
+	if ok == false {
+		return BatchResult{}, fmt.Errorf("no batch job %q", id)
+	}
+	return *result, nil
+}
@@ -0,0 +1,114 @@
+package procweb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunBatch(t *testing.T) {
+	config := InstanceConfig{Runner: workspaceRunner{}, Language: Languages["python"]}
+	req := BatchRequest{
+		Files: []FileMessage{
+			{Path: "game.py", Content: "import player"},
+			{Path: "player.py", Content: "name = 'bob'"},
+		},
+		Entrypoint: "game.py",
+	}
+	program, err := req.Program(config.Language)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := RunBatch(context.Background(), config, program, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "run python3 -u game.py\ngame.py: import player\nplayer.py: name = 'bob'\n"
+	if result.Status != BatchDone || result.Stdout != want || result.Exit == nil || result.Exit.Code != 0 {
+		t.Errorf("bad result %+v", result)
+	}
+
+	config = InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"]}
+	program, err = BatchRequest{Code: "print(io.read())"}.Program(config.Language)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = RunBatch(context.Background(), config, program, "one\ntwo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "one\ntwo\n" || result.Exit.Code != 0 {
+		t.Errorf("bad result %+v", result)
+	}
+}
+
+func TestRunBatchLimit(t *testing.T) {
+	config := InstanceConfig{
+		Runner:   FakeRunner{Program: fakeForever},
+		Language: Languages["luajit"],
+		Limits:   Limits{WallClock: 100 * time.Millisecond},
+	}
+	result, err := RunBatch(context.Background(), config, Program{Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Exit.Limit != "time limit exceeded (100ms)" || result.Exit.Code != 137 {
+		t.Errorf("bad exit %+v", result.Exit)
+	}
+}
+
+func TestBadBatchProgram(t *testing.T) {
+	lang := Languages["python"]
+	if _, err := (BatchRequest{Files: []FileMessage{{Path: "../main.py"}}}).Program(lang); err == nil {
+		t.Errorf("a file outside the workspace was accepted")
+	}
+	if _, err := (BatchRequest{Code: "print(1)", Entrypoint: "/main.py"}).Program(lang); err == nil {
+		t.Errorf("a bad entrypoint was accepted")
+	}
+
+	program, err := BatchRequest{Code: "print(1)", Entrypoint: "game.py"}.Program(lang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := InstanceConfig{Runner: workspaceRunner{}, Language: lang}
+	_, err = RunBatch(context.Background(), config, program, "")
+	var perr *ProtocolError
+	if errors.As(err, &perr) == false || perr.Code != ErrBadMessage {
+		t.Errorf("expected a missing entrypoint to be rejected, got %v", err)
+	}
+}
+
+func TestBatchJobs(t *testing.T) {
+	jobs := NewBatchJobs(context.Background())
+	jobs.Retention = 200 * time.Millisecond
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"]}
+	id, err := jobs.Start(config, Program{Files: NewWorkspace()}, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result BatchResult
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		result, err = jobs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status == BatchDone || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result.ID != id || result.Status != BatchDone || result.Stdout != "hi\n" || result.Exit.Code != 0 {
+		t.Errorf("bad result %+v", result)
+	}
+
+	// results are forgotten once they've been kept long enough
+	time.Sleep(400 * time.Millisecond)
+	if _, err := jobs.Get(id); err == nil {
+		t.Errorf("job %s outlived its retention", id)
+	}
+	if _, err := jobs.Get("nope"); err == nil {
+		t.Errorf("found a job that was never started")
+	}
+}
@@ -0,0 +1,674 @@
+package procweb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the docker daemon's socket on most installs
+const DefaultDockerSocket string = "/var/run/docker.sock"
+
+// the oldest Engine API version with everything we use (docker 20.10)
+const dockerAPIVersion string = "v1.41"
+
+// every instance container has this label, so we can find leftovers without touching anything else
+const containerLabel string = "openworkbook.instance"
+
+// how long to wait for docker to remove a container
+const containerRemoveTimeout = 30 * time.Second
+
+// a minimal client for the parts of the Docker Engine API that instances need
+// =====================================
+
+type dockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	dial := func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	return &dockerClient{
+		socket: socket,
+		http:   &http.Client{Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+// an error response from the docker daemon
+type dockerError struct {
+	Status  int
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %s (%d)", e.Message, e.Status)
+}
+
+// the URL for an API endpoint. The host is ignored since we always dial the socket
+func dockerURL(endpoint string, query url.Values) string {
+	u := "http://docker/" + dockerAPIVersion + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// make an API request, decoding the JSON response into result if it isn't nil
+func (c *dockerClient) do(ctx context.Context, method string, endpoint string, query url.Values, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, dockerURL(endpoint, query), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		dockerErr := dockerError{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(&dockerErr)
+		return &dockerErr
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// the parts of a container's configuration that we set, see the ContainerCreate docs
+type containerConfig struct {
+	Image           string
+	Cmd             []string
+	Env             []string
+	WorkingDir      string
+	User            string
+	Labels          map[string]string
+	AttachStdin     bool
+	AttachStdout    bool
+	AttachStderr    bool
+	OpenStdin       bool
+	StdinOnce       bool
+	Tty             bool
+	NetworkDisabled bool
+	HostConfig      hostConfig
+}
+
+type hostConfig struct {
+	Binds          []string
+	NetworkMode    string
+	ReadonlyRootfs bool
+	Tmpfs          map[string]string
+	Init           bool
+	CapDrop        []string
+	SecurityOpt    []string
+	Memory         int64
+	MemorySwap     int64
+	PidsLimit      int64 `json:",omitempty"`
+	Ulimits        []ulimit
+}
+
+type ulimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+// create a container, returning its ID
+func (c *dockerClient) create(ctx context.Context, name string, config containerConfig) (string, error) {
+	var result struct {
+		Id string
+	}
+	err := c.do(ctx, http.MethodPost, "/containers/create", url.Values{"name": {name}}, config, &result)
+	return result.Id, err
+}
+
+func (c *dockerClient) start(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// wait for a container to exit, returning its exit code
+func (c *dockerClient) wait(ctx context.Context, id string) (int, error) {
+	var result struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+	err := c.do(ctx, http.MethodPost, "/containers/"+id+"/wait", url.Values{"condition": {"next-exit"}}, nil, &result)
+	if err != nil {
+		return 0, err
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return result.StatusCode, errors.New(result.Error.Message)
+	}
+	return result.StatusCode, nil
+}
+
+// set the terminal size of a container or exec with a Tty, endpoint being its path
+func (c *dockerClient) resize(ctx context.Context, endpoint string, size TermSize) error {
+	query := url.Values{"h": {strconv.Itoa(int(size.Rows))}, "w": {strconv.Itoa(int(size.Cols))}}
+	return c.do(ctx, http.MethodPost, endpoint+"/resize", query, nil, nil)
+}
+
+// send a signal to a container's main process
+func (c *dockerClient) kill(ctx context.Context, id string, sig syscall.Signal) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/kill", url.Values{"signal": {strconv.Itoa(int(sig))}}, nil, nil)
+}
+
+// whether the kernel killed the container for going over its memory limit
+func (c *dockerClient) oomKilled(ctx context.Context, id string) (bool, error) {
+	var result struct {
+		State struct {
+			OOMKilled bool
+		}
+	}
+	err := c.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &result)
+	return result.State.OOMKilled, err
+}
+
+// force-remove a container, along with its anonymous volumes
+func (c *dockerClient) remove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil)
+}
+
+// the IDs of all containers with a label, running or not
+func (c *dockerClient) list(ctx context.Context, label string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	var result []struct {
+		Id string
+	}
+	err = c.do(ctx, http.MethodGet, "/containers/json", url.Values{"all": {"1"}, "filters": {string(filters)}}, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(result))
+	for _, v := range result {
+		ids = append(ids, v.Id)
+	}
+	return ids, nil
+}
+
+// a hijacked attach connection. Reads come from the buffered reader that parsed the HTTP
+// response, writes go straight to the socket
+type attachConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (a *attachConn) Read(p []byte) (int, error) {
+	return a.reader.Read(p)
+}
+
+// stop sending to the container's stdin, which closes it since containers are StdinOnce
+func (a *attachConn) CloseWrite() error {
+	if unixConn, ok := a.Conn.(*net.UnixConn); ok {
+		return unixConn.CloseWrite()
+	}
+	return a.Conn.Close()
+}
+
+// make an API request that takes over the connection for a raw stream, like attaching to a
+// container's stdio. These can't go through http.Client
+func (c *dockerClient) hijack(ctx context.Context, endpoint string, query url.Values, body any) (*attachConn, error) {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(http.MethodPost, dockerURL(endpoint, query), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.socket)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		dockerErr := dockerError{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(&dockerErr)
+		conn.Close()
+		return nil, &dockerErr
+	}
+
+	return &attachConn{Conn: conn, reader: reader}, nil
+}
+
+// attach to a container's stdio
+func (c *dockerClient) attach(ctx context.Context, id string) (*attachConn, error) {
+	query := url.Values{"stream": {"1"}, "stdin": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	return c.hijack(ctx, "/containers/"+id+"/attach", query, nil)
+}
+
+// the parts of an exec's configuration that we set, see the ContainerExec docs
+type execConfig struct {
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	User         string
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	Tty          bool
+}
+
+// run a command in a running container, returning the exec's ID and its stdio
+func (c *dockerClient) exec(ctx context.Context, id string, config execConfig) (string, *attachConn, error) {
+	var result struct {
+		Id string
+	}
+	err := c.do(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, config, &result)
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := c.hijack(ctx, "/exec/"+result.Id+"/start", nil, map[string]bool{"Detach": false, "Tty": config.Tty})
+	return result.Id, conn, err
+}
+
+// run a command in a running container without waiting for it or attaching to it
+func (c *dockerClient) execDetached(ctx context.Context, id string, config execConfig) error {
+	var result struct {
+		Id string
+	}
+	err := c.do(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, config, &result)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/exec/"+result.Id+"/start", nil, map[string]bool{"Detach": true}, nil)
+}
+
+// the exit code of a finished exec. Its stream can end a moment before docker notices the
+// process exited, so this polls until it has
+func (c *dockerClient) execExitCode(ctx context.Context, id string) (int, error) {
+	for {
+		var result struct {
+			Running  bool
+			ExitCode int
+		}
+		err := c.do(ctx, http.MethodGet, "/exec/"+id+"/json", nil, nil, &result)
+		if err != nil {
+			return 0, err
+		}
+		if result.Running == false {
+			return result.ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// split docker's multiplexed stdout/stderr stream into two writers. Each frame has an 8 byte
+// header: the stream (1 for stdout, 2 for stderr), three zero bytes, and the big endian size
+func demuxStream(src io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(src, header)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		var dest io.Writer
+		switch header[0] {
+		case 1:
+			dest = stdout
+		case 2:
+			dest = stderr
+		default:
+			dest = io.Discard
+		}
+		_, err = io.CopyN(dest, src, size)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect a job's stdio to a container's stream, returning once all of the output has been read
+func streamJob(ctx context.Context, cancel context.CancelFunc, conn *attachConn, job *Job) {
+	stdin := job.Stdin
+	if job.PTY {
+		stdin = ptyStdin(ctx, stdin)
+	}
+	// stdin goes straight into the connection, closing our side of it when the input ends
+	stdinReader, stdinWriter := io.Pipe()
+	go inScanner(ctx, cancel, stdinWriter, stdin, job.logger())
+	go func() {
+		io.Copy(conn, stdinReader)
+		conn.CloseWrite()
+	}()
+
+	// a terminal's output is one raw stream
+	if job.PTY {
+		close(job.Stderr)
+		outScanner(ctx, cancel, conn, job.Stdout, "stdout", job.logger())
+		stdinReader.Close()
+		return
+	}
+
+	// output comes back multiplexed
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	go func() {
+		err := demuxStream(conn, stdoutWriter, stderrWriter)
+		stdoutWriter.CloseWithError(err)
+		stderrWriter.CloseWithError(err)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stdoutReader, job.Stdout, "stdout", job.logger())
+	}()
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stderrReader, job.Stderr, "stderr", job.logger())
+	}()
+	wg.Wait()
+	stdinReader.Close()
+}
+
+// DockerRunner
+// =====================================
+
+// DockerRunner runs each program in its own container by talking to the docker daemon's
+// Engine API. Containers have no network, a read-only root, a tmpfs /tmp, run as a
+// non-root user, and get the instance's limits as cgroup limits.
+// It names and tracks every container, so that they can be removed when an instance is
+// cancelled or the server shuts down
+type DockerRunner struct {
+	// counts how long containers take to start, nil for not counting
+	Metrics *Metrics
+
+	client *dockerClient
+
+	mtx        sync.Mutex
+	containers map[string]struct{}
+}
+
+// create a DockerRunner that talks to the daemon listening on socket, DefaultDockerSocket if empty
+func NewDockerRunner(socket string) *DockerRunner {
+	if socket == "" {
+		socket = DefaultDockerSocket
+	}
+	return &DockerRunner{
+		client:     newDockerClient(socket),
+		containers: make(map[string]struct{}),
+	}
+}
+
+// a new random container name
+func containerName() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return "owb-" + hex.EncodeToString(id), nil
+}
+
+// the user that containers run as. When the server runs as root, that is the unprivileged
+// nobody user, otherwise it's the server's own user, so that containers can use the
+// source files the server writes
+func containerUser() (int, int) {
+	if os.Getuid() == 0 {
+		return 65534, 65534
+	}
+	return os.Getuid(), os.Getgid()
+}
+
+// the environment that programs run with in containers
+var containerEnv = []string{"HOME=/tmp", "TMPDIR=/tmp", "LANG=C.UTF-8"}
+
+// give the container user everything under dir, if it isn't us
+func chownForContainer(dir string) error {
+	uid, gid := containerUser()
+	if uid == os.Getuid() {
+		return nil
+	}
+	return chownTree(dir, uid, gid)
+}
+
+// the container configuration for a job
+func dockerJobConfig(job *Job) containerConfig {
+	uid, gid := containerUser()
+	config := containerConfig{
+		Image:           job.Language.Image,
+		Cmd:             job.Language.Command(),
+		Env:             slices.Concat(containerEnv, termEnv(job)),
+		WorkingDir:      "/source",
+		User:            fmt.Sprintf("%d:%d", uid, gid),
+		Labels:          map[string]string{containerLabel: ""},
+		AttachStdin:     true,
+		AttachStdout:    true,
+		AttachStderr:    true,
+		OpenStdin:       true,
+		StdinOnce:       true,
+		Tty:             job.PTY,
+		NetworkDisabled: true,
+		HostConfig: hostConfig{
+			Binds:          []string{job.Dir + ":/source"},
+			NetworkMode:    "none",
+			ReadonlyRootfs: true,
+			Tmpfs:          map[string]string{"/tmp": "rw,nosuid,nodev,size=16m"},
+			// the program runs under an init process, so signals that kill it are reported as 128+signal
+			Init:        true,
+			CapDrop:     []string{"ALL"},
+			SecurityOpt: []string{"no-new-privileges"},
+			Memory:      job.Limits.Memory,
+			MemorySwap:  job.Limits.Memory,
+			PidsLimit:   job.Limits.Processes,
+		},
+	}
+	if job.Limits.CPUTime != 0 {
+		// going over the soft limit sends SIGXCPU, the hard limit only catches programs that ignore it
+		seconds := cpuSeconds(job.Limits.CPUTime)
+		config.HostConfig.Ulimits = []ulimit{{Name: "cpu", Soft: seconds, Hard: seconds + 1}}
+	}
+	return config
+}
+
+func (r *DockerRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	// the program needs to be able to use its source files
+	err := chownForContainer(job.Dir)
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	starting := time.Now()
+	id, err := r.createContainer(ctx, dockerJobConfig(job))
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer r.remove(id, job.logger())
+
+	// attach and start waiting before the container starts, so we don't miss anything
+	conn, err := r.client.attach(ctx, id)
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer conn.Close()
+	// unblock reads from the container if the instance gets cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	type waitResult struct {
+		code int
+		err  error
+	}
+	waitChan := make(chan waitResult, 1)
+	go func() {
+		code, err := r.client.wait(ctx, id)
+		waitChan <- waitResult{code, err}
+	}()
+
+	err = r.client.start(ctx, id)
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	r.Metrics.containerStarted("cold", starting)
+	controlCtx, stopControls := context.WithCancel(ctx)
+	defer stopControls()
+	if job.PTY {
+		// docker doesn't give terminals a size of their own
+		endpoint := "/containers/" + id
+		err = r.client.resize(ctx, endpoint, job.termSize())
+		if err != nil {
+			job.logger().Warn("failed to resize terminal", "err", err)
+		}
+		go applyEach(controlCtx, job.Resize, job.logger(), func(size TermSize) error {
+			return r.client.resize(controlCtx, endpoint, size)
+		})
+	}
+	// the container's init passes signals on to the program
+	var signals sentSignals
+	go applyEach(controlCtx, job.Signals, job.logger(), func(sig syscall.Signal) error {
+		signals.add(sig)
+		return r.client.kill(controlCtx, id, sig)
+	})
+
+	streamJob(ctx, cancel, conn, job)
+
+	result := <-waitChan
+	if result.err != nil {
+		return result.err
+	}
+
+	oom, err := r.client.oomKilled(context.Background(), id)
+	if err == nil && oom {
+		return memoryLimitError(job.Limits)
+	}
+	if result.code != 0 {
+		return signals.exitError(result.code)
+	}
+	return nil
+}
+
+// create a container with a new name and start tracking it, returning its ID
+func (r *DockerRunner) createContainer(ctx context.Context, config containerConfig) (string, error) {
+	name, err := containerName()
+	if err != nil {
+		return "", err
+	}
+	id, err := r.client.create(ctx, name, config)
+	if err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	r.containers[id] = struct{}{}
+	r.mtx.Unlock()
+	return id, nil
+}
+
+// force-remove a container and stop tracking it. log is the logger of the run the container
+// belonged to, or ProcLog
+func (r *DockerRunner) remove(id string, log *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), containerRemoveTimeout)
+	defer cancel()
+	err := r.client.remove(ctx, id)
+	if err != nil {
+		log.Error("failed to remove container", "container", id, "err", err)
+		return
+	}
+
+	r.mtx.Lock()
+	delete(r.containers, id)
+	r.mtx.Unlock()
+}
+
+// remove every instance container, including ones left behind by earlier runs of the server
+func (r *DockerRunner) Reap(ctx context.Context) error {
+	ids, err := r.client.list(ctx, containerLabel)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		ProcLog.Info("removing leftover container", "container", id)
+		r.remove(id, ProcLog)
+	}
+	return nil
+}
+
+// remove the containers of all running instances
+func (r *DockerRunner) Close() error {
+	r.mtx.Lock()
+	ids := make([]string, 0, len(r.containers))
+	for id := range r.containers {
+		ids = append(ids, id)
+	}
+	r.mtx.Unlock()
+
+	for _, id := range ids {
+		r.remove(id, ProcLog)
+	}
+	return nil
+}
@@ -0,0 +1,647 @@
+package procweb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a fake docker daemon
+// ===========================
+
+// a container in the fake daemon. Once started, its program (or any exec in it) echoes each
+// line of stdin to stdout, and when stdin closes it writes "bye" to stderr and exits with exitCode.
+// A hanging container ignores stdin and only stops when it's removed
+type fakeContainer struct {
+	config  containerConfig
+	started chan struct{}
+	exited  chan struct{}
+	exit    sync.Once
+	removed bool
+}
+
+// a command run in a fake container, and the source files it could see
+type fakeExec struct {
+	container *fakeContainer
+	config    execConfig
+	files     map[string]string
+}
+
+type fakeDocker struct {
+	socket    string
+	exitCode  int
+	oomKilled bool
+	hang      bool
+
+	mtx        sync.Mutex
+	containers map[string]*fakeContainer
+	execs      map[string]*fakeExec
+	// containers that a previous server left behind
+	leftovers []string
+	removed   []string
+	// terminal sizes that containers were given, like 24x80
+	resizes []string
+	// signals that were sent, either by number through the API or by the command that sent them
+	signals []string
+}
+
+func (d *fakeDocker) container(id string) *fakeContainer {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.containers[id]
+}
+
+// write one frame of docker's multiplexed stream
+func writeFrame(w *bufio.ReadWriter, stream byte, body string) {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(body)))
+	w.Write(header)
+	w.WriteString(body)
+	w.Flush()
+}
+
+// stop a container's program as if a signal had killed it
+func (d *fakeDocker) signal(c *fakeContainer, sig string) {
+	d.mtx.Lock()
+	d.signals = append(d.signals, sig)
+	d.mtx.Unlock()
+	c.exit.Do(func() { close(c.exited) })
+}
+
+// hijack the connection and run the container's fake program on it. Output on a terminal
+// is raw, otherwise it's multiplexed, and a ^D ends a terminal's input
+func (d *fakeDocker) serveStream(w http.ResponseWriter, r *http.Request, c *fakeContainer, tty bool) {
+	// read the request before taking over the connection, like docker does
+	io.Copy(io.Discard, r.Body)
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	rw.Flush()
+
+	write := func(stream byte, body string) {
+		if tty {
+			rw.WriteString(body)
+			rw.Flush()
+			return
+		}
+		writeFrame(rw, stream, body)
+	}
+
+	<-c.started
+	if d.hang {
+		<-c.exited
+		return
+	}
+	var line []byte
+	for {
+		b, err := rw.ReadByte()
+		if err != nil || (tty && b == 4) {
+			break
+		}
+		line = append(line, b)
+		if b == '\n' {
+			write(1, string(line))
+			line = nil
+		}
+	}
+	if len(line) > 0 {
+		write(1, string(line))
+	}
+	write(2, "bye\n")
+}
+
+func (d *fakeDocker) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	prefix := "/" + dockerAPIVersion
+
+	mux.HandleFunc("POST "+prefix+"/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var config containerConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, `{"message": "bad config"}`, http.StatusBadRequest)
+			return
+		}
+		id := r.URL.Query().Get("name") + "-id"
+		d.mtx.Lock()
+		d.containers[id] = &fakeContainer{
+			config:  config,
+			started: make(chan struct{}),
+			exited:  make(chan struct{}),
+		}
+		d.mtx.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": %q}`, id)
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/attach", func(w http.ResponseWriter, r *http.Request) {
+		c := d.container(r.PathValue("id"))
+		if c == nil {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		d.serveStream(w, r, c, c.config.Tty)
+		c.exit.Do(func() { close(c.exited) })
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		c := d.container(r.PathValue("id"))
+		if c == nil {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		e := &fakeExec{container: c, files: make(map[string]string)}
+		if err := json.NewDecoder(r.Body).Decode(&e.config); err != nil {
+			http.Error(w, `{"message": "bad config"}`, http.StatusBadRequest)
+			return
+		}
+		// remember what the program could see in /source
+		hostDir, _, _ := strings.Cut(c.config.HostConfig.Binds[0], ":")
+		entries, _ := os.ReadDir(hostDir)
+		for _, entry := range entries {
+			content, _ := os.ReadFile(path.Join(hostDir, entry.Name()))
+			e.files[entry.Name()] = string(content)
+		}
+
+		d.mtx.Lock()
+		id := fmt.Sprintf("exec-%d", len(d.execs))
+		d.execs[id] = e
+		d.mtx.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": %q}`, id)
+	})
+
+	mux.HandleFunc("POST "+prefix+"/exec/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		d.mtx.Lock()
+		e := d.execs[r.PathValue("id")]
+		d.mtx.Unlock()
+		var start struct {
+			Detach bool
+		}
+		json.NewDecoder(r.Body).Decode(&start)
+		// the only detached execs are kill commands
+		if start.Detach {
+			d.signal(e.container, strings.Join(e.config.Cmd, " "))
+			return
+		}
+		d.serveStream(w, r, e.container, e.config.Tty)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Running": false, "ExitCode": %d}`, d.exitCode)
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		close(d.container(r.PathValue("id")).started)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		c := d.container(r.PathValue("id"))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.exited:
+		}
+		fmt.Fprintf(w, `{"StatusCode": %d}`, d.exitCode)
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/resize", func(w http.ResponseWriter, r *http.Request) {
+		d.mtx.Lock()
+		d.resizes = append(d.resizes, r.URL.Query().Get("h")+"x"+r.URL.Query().Get("w"))
+		d.mtx.Unlock()
+	})
+
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/kill", func(w http.ResponseWriter, r *http.Request) {
+		d.signal(d.container(r.PathValue("id")), r.URL.Query().Get("signal"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"State": {"OOMKilled": %t}}`, d.oomKilled)
+	})
+
+	mux.HandleFunc("DELETE "+prefix+"/containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		d.mtx.Lock()
+		d.removed = append(d.removed, id)
+		c := d.containers[id]
+		if c != nil {
+			c.removed = true
+		}
+		d.mtx.Unlock()
+		if c != nil {
+			c.exit.Do(func() { close(c.exited) })
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		if len(filters["label"]) != 1 || filters["label"][0] != containerLabel {
+			http.Error(w, `{"message": "expected a label filter"}`, http.StatusBadRequest)
+			return
+		}
+		list := []map[string]string{}
+		for _, id := range d.leftovers {
+			list = append(list, map[string]string{"Id": id})
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+
+	return mux
+}
+
+// start a fake docker daemon listening on a unix socket in a temporary directory
+func startFakeDocker(t *testing.T) *fakeDocker {
+	d := &fakeDocker{
+		socket:     path.Join(t.TempDir(), "docker.sock"),
+		containers: make(map[string]*fakeContainer),
+		execs:      make(map[string]*fakeExec),
+	}
+	listener, err := net.Listen("unix", d.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: d.routes()}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return d
+}
+
+// run a python job with the given stdin through runner
+func runFakeDockerJob(t *testing.T, runner Runner, ctx context.Context, limits Limits, stdin string, closeStdin bool, pty bool) (string, string, error) {
+	return runFakeDockerJobSignalled(t, runner, ctx, limits, stdin, closeStdin, pty, 0)
+}
+
+// run a python job through runner, sending it sig as soon as it starts if sig isn't 0
+func runFakeDockerJobSignalled(t *testing.T, runner Runner, ctx context.Context, limits Limits, stdin string, closeStdin bool, pty bool, sig syscall.Signal) (string, string, error) {
+	job := Job{
+		Dir:      t.TempDir(),
+		Language: Languages["python"],
+		Limits:   limits,
+		PTY:      pty,
+		Signals:  make(chan syscall.Signal, 1),
+		Stdin:    make(chan []byte, 8),
+		Stdout:   make(chan ProcMessage, 8),
+		Stderr:   make(chan ProcMessage, 8),
+	}
+	if sig != 0 {
+		job.Signals <- sig
+	}
+	err := os.WriteFile(path.Join(job.Dir, "main.py"), []byte("print(input())\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Stdin <- []byte(stdin)
+	if closeStdin {
+		close(job.Stdin)
+	}
+
+	var stdout, stderr strings.Builder
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for msg := range job.Stderr {
+			stderr.WriteString(msg.Body)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for msg := range job.Stdout {
+			stdout.WriteString(msg.Body)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err = runner.Run(ctx, cancel, &job)
+	wg.Wait()
+	return stdout.String(), stderr.String(), err
+}
+
+// run a job through a new DockerRunner talking to d
+func runInFakeDocker(t *testing.T, d *fakeDocker, ctx context.Context, stdin string) (*DockerRunner, string, string, error) {
+	runner := NewDockerRunner(d.socket)
+	stdout, stderr, err := runFakeDockerJob(t, runner, ctx, DefaultLimits, stdin, d.hang == false, false)
+	return runner, stdout, stderr, err
+}
+
+// DockerRunner tests
+// ===========================
+
+func TestDockerRunner(t *testing.T) {
+	d := startFakeDocker(t)
+	d.exitCode = 3
+	runner, stdout, stderr, err := runInFakeDocker(t, d, context.Background(), "one\ntwo\n")
+
+	if stdout != "one\ntwo\n" || stderr != "bye\n" {
+		t.Errorf("bad output: stdout %q, stderr %q", stdout, stderr)
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) == false || exitErr.Code != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+
+	if len(d.containers) != 1 {
+		t.Fatalf("expected one container, got %d", len(d.containers))
+	}
+	for id, c := range d.containers {
+		if strings.HasPrefix(id, "owb-") == false {
+			t.Errorf("bad container name %s", id)
+		}
+		if c.removed == false {
+			t.Errorf("container %s wasn't removed", id)
+		}
+
+		config := c.config
+		host := config.HostConfig
+		if host.NetworkMode != "none" || config.NetworkDisabled == false {
+			t.Errorf("container has a network")
+		}
+		if host.ReadonlyRootfs == false {
+			t.Errorf("container root is writable")
+		}
+		if _, ok := host.Tmpfs["/tmp"]; ok == false {
+			t.Errorf("container has no scratch dir")
+		}
+		if config.User == "" || strings.HasPrefix(config.User, "0:") {
+			t.Errorf("container runs as root (%q)", config.User)
+		}
+		if host.Memory != DefaultLimits.Memory || host.PidsLimit != DefaultLimits.Processes {
+			t.Errorf("bad cgroup limits: memory %d, pids %d", host.Memory, host.PidsLimit)
+		}
+		if len(host.Ulimits) != 1 || host.Ulimits[0].Soft != cpuSeconds(DefaultLimits.CPUTime) {
+			t.Errorf("bad CPU ulimit: %+v", host.Ulimits)
+		}
+		if slices.Contains(config.Env, "LINES=24") == false || slices.Contains(config.Env, "COLUMNS=80") == false {
+			t.Errorf("container wasn't told the terminal size: %q", config.Env)
+		}
+		if config.Labels[containerLabel] != "" || len(config.Labels) != 1 {
+			t.Errorf("bad labels: %v", config.Labels)
+		}
+	}
+	if len(runner.containers) != 0 {
+		t.Errorf("container is still tracked after the run finished")
+	}
+}
+
+func TestDockerRunnerPTY(t *testing.T) {
+	d := startFakeDocker(t)
+	runner := NewDockerRunner(d.socket)
+	stdout, stderr, err := runFakeDockerJob(t, runner, context.Background(), DefaultLimits, "one\ntwo", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything comes back raw on stdout, and the end of input is a ^D rather than a hang up
+	if stdout != "one\ntwobye\n" || stderr != "" {
+		t.Errorf("bad output: stdout %q, stderr %q", stdout, stderr)
+	}
+	for _, c := range d.containers {
+		if c.config.Tty == false {
+			t.Errorf("container wasn't given a terminal")
+		}
+		if slices.ContainsFunc(c.config.Env, func(v string) bool { return strings.HasPrefix(v, "LINES=") }) {
+			t.Errorf("a terminal's size shouldn't be fixed by the environment: %q", c.config.Env)
+		}
+	}
+	if len(d.resizes) != 1 || d.resizes[0] != "24x80" {
+		t.Errorf("terminal wasn't sized: %q", d.resizes)
+	}
+}
+
+func TestDockerRunnerOOM(t *testing.T) {
+	d := startFakeDocker(t)
+	d.exitCode = 137
+	d.oomKilled = true
+	_, _, _, err := runInFakeDocker(t, d, context.Background(), "")
+
+	want := "memory limit exceeded (256 MiB)"
+	if limit := exitLimit(err, DefaultLimits, Usage{}); limit == nil || limit.Kind != LimitKindMemory || limit.Reason != want {
+		t.Errorf("expected %q, got %+v", want, limit)
+	}
+}
+
+func TestDockerRunnerCancel(t *testing.T) {
+	d := startFakeDocker(t)
+	d.hang = true
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	runner, _, _, _ := runInFakeDocker(t, d, ctx, "ignored\n")
+
+	if len(d.removed) != 1 || strings.HasPrefix(d.removed[0], "owb-") == false {
+		t.Errorf("expected the cancelled container to be removed, got %q", d.removed)
+	}
+	if len(runner.containers) != 0 {
+		t.Errorf("container is still tracked after the run finished")
+	}
+}
+
+func TestDockerRunnerSignal(t *testing.T) {
+	d := startFakeDocker(t)
+	d.hang = true
+	d.exitCode = 130
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	runner := NewDockerRunner(d.socket)
+	_, _, err := runFakeDockerJobSignalled(t, runner, ctx, DefaultLimits, "", false, false, syscall.SIGINT)
+
+	if ctx.Err() != nil {
+		t.Fatal("the signal didn't stop the container")
+	}
+	if len(d.signals) != 1 || d.signals[0] != "2" {
+		t.Errorf("expected the container to get SIGINT, got %q", d.signals)
+	}
+	if got := describeExit(err, false, ""); got != "terminated by SIGINT" {
+		t.Errorf("bad exit %q (%v)", got, err)
+	}
+}
+
+func TestDockerRunnerReap(t *testing.T) {
+	d := startFakeDocker(t)
+	d.leftovers = []string{"owb-leftover"}
+	runner := NewDockerRunner(d.socket)
+
+	err := runner.Reap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.removed) != 1 || d.removed[0] != "owb-leftover" {
+		t.Errorf("expected the leftover container to be removed, got %q", d.removed)
+	}
+}
+
+// PoolRunner tests
+// ===========================
+
+// wait for the pool to have idle containers for language
+func waitForIdle(t *testing.T, pool *PoolRunner, language string, idle int) PoolStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, stats := range pool.Stats() {
+			if stats.Language == language && stats.Idle == idle {
+				return stats
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s pool never got %d idle containers: %+v", language, idle, pool.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolRunner(t *testing.T) {
+	d := startFakeDocker(t)
+	d.exitCode = 3
+	targets := PoolTargets{}
+	err := targets.Set("python=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPoolRunner(NewDockerRunner(d.socket), PoolConfig{Targets: targets, Limits: DefaultLimits})
+	pool.Start(context.Background())
+	waitForIdle(t, pool, "python", 1)
+	for _, stats := range pool.Stats() {
+		if stats.Language != "python" && stats.Idle != 0 {
+			t.Errorf("the %s pool should be off: %+v", stats.Language, stats)
+		}
+	}
+
+	// a warm run goes through exec, with the program copied into the container
+	stdout, stderr, err := runFakeDockerJob(t, pool, context.Background(), DefaultLimits, "warm\n", true, false)
+	if stdout != "warm\n" || stderr != "bye\n" {
+		t.Errorf("bad output: stdout %q, stderr %q", stdout, stderr)
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) == false || exitErr.Code != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	d.mtx.Lock()
+	if len(d.execs) != 1 {
+		t.Fatalf("expected one exec, got %d", len(d.execs))
+	}
+	for _, e := range d.execs {
+		if e.files["main.py"] != "print(input())\n" {
+			t.Errorf("program wasn't injected: %q", e.files)
+		}
+		if slices.Equal(e.config.Cmd, Languages["python"].Command()) == false {
+			t.Errorf("bad exec command %q", e.config.Cmd)
+		}
+		if e.config.User == "" || strings.HasPrefix(e.config.User, "0:") {
+			t.Errorf("exec runs as root (%q)", e.config.User)
+		}
+		if e.container.removed == false {
+			t.Errorf("used container wasn't removed")
+		}
+	}
+	d.mtx.Unlock()
+
+	// the used container gets replaced
+	stats := waitForIdle(t, pool, "python", 1)
+	if stats.Hits != 1 || stats.Misses != 0 {
+		t.Errorf("bad stats after a warm run: %+v", stats)
+	}
+
+	// jobs with other limits start their own container
+	other := DefaultLimits
+	other.Memory = 64 << 20
+	stdout, _, _ = runFakeDockerJob(t, pool, context.Background(), other, "cold\n", true, false)
+	if stdout != "cold\n" {
+		t.Errorf("bad output from a cold run: %q", stdout)
+	}
+	stats = waitForIdle(t, pool, "python", 1)
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("bad stats after a cold run: %+v", stats)
+	}
+
+	// signals go to the program from inside the container, since docker would send them to the idle command
+	d.hang = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	runFakeDockerJobSignalled(t, pool, ctx, DefaultLimits, "", false, false, syscall.SIGTERM)
+	if ctx.Err() != nil {
+		t.Fatal("the signal didn't stop the pooled container")
+	}
+	d.mtx.Lock()
+	if len(d.signals) != 1 || d.signals[0] != "/bin/sh -c kill -s TERM -1" {
+		t.Errorf("expected a kill command, got %q", d.signals)
+	}
+	d.mtx.Unlock()
+
+	err = pool.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if len(d.removed) != len(d.containers) {
+		t.Errorf("closing the pool left containers behind: %d created, %d removed", len(d.containers), len(d.removed))
+	}
+}
+
+// an OOM kill in a warm container is the program's, even though the container lives on
+func TestPoolRunnerOOM(t *testing.T) {
+	d := startFakeDocker(t)
+	d.exitCode = 137
+	d.oomKilled = true
+	targets := PoolTargets{}
+	err := targets.Set("python=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPoolRunner(NewDockerRunner(d.socket), PoolConfig{Targets: targets, Limits: DefaultLimits})
+	pool.Start(context.Background())
+	defer pool.Close()
+	waitForIdle(t, pool, "python", 1)
+
+	_, _, err = runFakeDockerJob(t, pool, context.Background(), DefaultLimits, "", true, false)
+	want := "memory limit exceeded (256 MiB)"
+	if limit := exitLimit(err, DefaultLimits, Usage{}); limit == nil || limit.Kind != LimitKindMemory || limit.Reason != want {
+		t.Errorf("expected %q, got %v (%+v)", want, err, limit)
+	}
+	for _, stats := range pool.Stats() {
+		if stats.Language == "python" && stats.Hits != 1 {
+			t.Errorf("the run didn't use the pool: %+v", stats)
+		}
+	}
+}
+
+func TestPoolTargets(t *testing.T) {
+	var targets PoolTargets
+	err := targets.Set("python=4,c=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets.String() != "c=0,python=4" {
+		t.Errorf("bad targets %s", targets.String())
+	}
+	config := PoolConfig{Size: 2, Targets: targets}
+	if config.target("python") != 4 || config.target("c") != 0 || config.target("lua") != 2 {
+		t.Errorf("bad per-language targets")
+	}
+
+	for _, bad := range []string{"python", "cobol=1", "python=-1"} {
+		if (&PoolTargets{}).Set(bad) == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package procweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// binary framing
+// =====================================
+
+// the websocket subprotocol for binary frames. Connections that don't ask for it when they
+// open send ProcMessages as JSON text messages
+const BinarySubprotocol = "procweb.binary"
+
+// a binary frame is one websocket binary message:
+//
+//	type   1 byte
+//	stream 1 byte
+//	seq    uvarint
+//	time   varint
+//	payload, the rest of the message
+//
+// Data frames carry stdin, stdout or stderr, depending on their stream, with the raw bytes
+// as their payload. Every other message is a named frame, whose payload is its category,
+// a zero byte and then its body
+const (
+	frameNamed byte = iota
+	frameData
+)
+
+// the streams of data frames
+var frameStreams = []string{"stdin", "stdout", "stderr"}
+
+// whether ws sends binary frames rather than JSON
+func framed(ws *websocket.Conn) bool {
+	return ws.Subprotocol() == BinarySubprotocol
+}
+
+// the binary frame for msg
+func encodeFrame(msg ProcMessage) []byte {
+	b := make([]byte, 2, 2+2*binary.MaxVarintLen64+len(msg.Category)+1+len(msg.Body))
+	stream := -1
+	for i, v := range frameStreams {
+		if v == msg.Category {
+			stream = i
+		}
+	}
+	if stream == -1 {
+		b[0] = frameNamed
+	} else {
+		b[0] = frameData
+		b[1] = byte(stream)
+	}
+	b = binary.AppendUvarint(b, msg.Seq)
+	b = binary.AppendVarint(b, msg.Time)
+	if stream == -1 {
+		b = append(b, msg.Category...)
+		b = append(b, 0)
+	}
+	return append(b, msg.Body...)
+}
+
+// the ProcMessage in a binary frame
+func decodeFrame(b []byte) (ProcMessage, error) {
+	var msg ProcMessage
+	if len(b) < 2 {
+		return msg, errors.New("short frame")
+	}
+	frameType, stream := b[0], b[1]
+	b = b[2:]
+
+	seq, n := binary.Uvarint(b)
+	if n <= 0 {
+		return msg, errors.New("bad frame seq")
+	}
+	b = b[n:]
+	captured, n := binary.Varint(b)
+	if n <= 0 {
+		return msg, errors.New("bad frame time")
+	}
+	b = b[n:]
+	msg.Seq = seq
+	msg.Time = captured
+
+	switch frameType {
+	case frameNamed:
+		category, body, ok := bytes.Cut(b, []byte{0})
+		if ok == false {
+			return msg, errors.New("named frame without a category")
+		}
+		msg.Category = string(category)
+		msg.Body = string(body)
+	case frameData:
+		if int(stream) >= len(frameStreams) {
+			return msg, fmt.Errorf("bad frame stream %d", stream)
+		}
+		msg.Category = frameStreams[stream]
+		msg.Body = string(b)
+	default:
+		return msg, fmt.Errorf("bad frame type %d", frameType)
+	}
+	return msg, nil
+}
+
+// read the next message from ws, in whichever format the connection uses
+func readProcMessage(ws *websocket.Conn) (ProcMessage, error) {
+	if framed(ws) == false {
+		var msg ProcMessage
+		err := ws.ReadJSON(&msg)
+		return msg, err
+	}
+	messageType, b, err := ws.ReadMessage()
+	if err != nil {
+		return ProcMessage{}, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return ProcMessage{}, errors.New("text message on a binary connection")
+	}
+	return decodeFrame(b)
+}
+
+// write msg to ws, in whichever format the connection uses. The caller holds the socket's lock
+func writeProcMessage(ws *websocket.Conn, msg ProcMessage) error {
+	if framed(ws) == false {
+		return ws.WriteJSON(msg)
+	}
+	return ws.WriteMessage(websocket.BinaryMessage, encodeFrame(msg))
+}
@@ -0,0 +1,166 @@
+package procweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/gorilla/websocket"
+)
+
+// any message without a zero byte in its category should come out of a frame as it went in
+func frameIdentityHolds(in ProcMessage) bool {
+	in.Category = strings.ReplaceAll(in.Category, "\x00", "")
+	in.Encoding = ""
+	out, err := decodeFrame(encodeFrame(in))
+	return err == nil && out == in
+}
+
+func TestFrameIdentity(t *testing.T) {
+	c := quick.Config{MaxCount: 10_000}
+	if err := quick.Check(frameIdentityHolds, &c); err != nil {
+		t.Error(err)
+	}
+	for _, category := range []string{"stdin", "stdout", "stderr", "exit"} {
+		if frameIdentityHolds(ProcMessage{Category: category, Body: "\x89PNG", Seq: 3, Time: captureTime()}) == false {
+			t.Errorf("%s didn't survive a frame", category)
+		}
+	}
+}
+
+func TestFrameFormat(t *testing.T) {
+	frame := encodeFrame(ProcMessage{Category: "stderr", Body: "oops", Seq: 1, Time: 2})
+	if want := []byte{frameData, 2, 1, 4, 'o', 'o', 'p', 's'}; bytes.Equal(frame, want) == false {
+		t.Errorf("want %v, got %v", want, frame)
+	}
+	frame = encodeFrame(ProcMessage{Category: "EOF", Body: "stdin"})
+	if want := []byte("\x00\x00\x00\x00EOF\x00stdin"); bytes.Equal(frame, want) == false {
+		t.Errorf("want %q, got %q", want, frame)
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		{frameData},
+		{frameData, 7, 0, 0},
+		{9, 0, 0, 0},
+		{frameNamed, 0, 0, 0, 'E', 'O', 'F'},
+		{frameNamed, 0, 0x80},
+	} {
+		if _, err := decodeFrame(bad); err == nil {
+			t.Errorf("%v should be rejected", bad)
+		}
+	}
+}
+
+func TestFramedConnection(t *testing.T) {
+	var mtx sync.Mutex
+	readSock, writeSock := createFramedSockets()
+	if framed(readSock) == false || framed(writeSock) == false {
+		t.Fatal("the sockets didn't agree on binary frames")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := ScanProcConnection(ctx, cancel, readSock, &mtx, ProcLog)
+
+	out := make(chan ProcMessage, 8)
+	SendProcConnection(ctx, cancel, writeSock, &mtx, ProcLog, out, "")
+	want := []ProcMessage{
+		{Category: "stdin", Body: "\xff\xfe"},
+		{Category: "resize", Body: `{"rows": 24, "cols": 80}`},
+	}
+	for _, msg := range want {
+		out <- msg
+	}
+	close(out)
+	for _, msg := range want {
+		if got := <-in; got != msg {
+			t.Errorf("want %+v, got %+v", msg, got)
+		}
+	}
+}
+
+func TestFramedInstance(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeBinary}, Language: Languages["luajit"]}
+	ourSock, instanceSock := createFramedSockets()
+	msgs, err := runInstanceOver(ourSock, instanceSock, config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "features": ["exit", "base64"]}`},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Category != "welcome" || msgs[0].Seq != 1 {
+		t.Errorf("expected a welcome first, got %+v", msgs[0])
+	}
+	// binary frames don't need base64
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != "\x89PNG\r\n" {
+		t.Errorf("bad output %q", stdout.Body)
+	}
+	if exit := exitStatus(t, msgs); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+}
+
+// benchmarks
+// ===========================
+
+// a chunk of output like a print loop sends
+var benchMessage = ProcMessage{Category: "stdout", Body: strings.Repeat("spam spam spam\n", 64), Seq: 12345, Time: captureTime()}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	b.SetBytes(int64(len(benchMessage.Body)))
+	for b.Loop() {
+		json.Marshal(benchMessage)
+	}
+}
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	b.SetBytes(int64(len(benchMessage.Body)))
+	for b.Loop() {
+		encodeFrame(benchMessage)
+	}
+}
+
+// send messages from one socket to the other as fast as they go
+func benchmarkConnection(b *testing.B, createSockets func() (*websocket.Conn, *websocket.Conn), msg ProcMessage) {
+	var mtx sync.Mutex
+	readSock, writeSock := createSockets()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := ScanProcConnection(ctx, cancel, readSock, &mtx, ProcLog)
+	out := make(chan ProcMessage, 64)
+	SendProcConnection(ctx, cancel, writeSock, &mtx, ProcLog, out, "")
+
+	b.SetBytes(int64(len(msg.Body)))
+	b.ResetTimer()
+	go func() {
+		defer close(out)
+		for i := 0; i < b.N; i++ {
+			out <- msg
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-in
+	}
+}
+
+func BenchmarkConnectionJSON(b *testing.B) {
+	benchmarkConnection(b, createSockets, benchMessage)
+}
+
+func BenchmarkConnectionFrames(b *testing.B) {
+	benchmarkConnection(b, createFramedSockets, benchMessage)
+}
+
+// keystrokes, where the overhead is most of the message
+func BenchmarkKeystrokesJSON(b *testing.B) {
+	benchmarkConnection(b, createSockets, ProcMessage{Category: "stdin", Body: "a"})
+}
+
+func BenchmarkKeystrokesFrames(b *testing.B) {
+	benchmarkConnection(b, createFramedSockets, ProcMessage{Category: "stdin", Body: "a"})
+}
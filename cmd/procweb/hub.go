@@ -0,0 +1,121 @@
+package procweb
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// viewers
+// =====================================
+
+// how many messages a viewer can fall behind by before it's dropped
+const DefaultViewerBacklog = 256
+
+// the ways a viewer can join an instance
+const (
+	// see everything the program sends, but send it nothing
+	ViewerWatch = "watch"
+	// type into the program and signal it too, like its owner
+	ViewerPair = "pair"
+)
+
+// a Hub lets more clients join running instances that have been shared with them, to watch
+// them or to pair on them. An instructor can watch a student's terminal live, or two students
+// can work on one program
+type Hub struct {
+	// how many messages a viewer can fall behind by. Zero means DefaultViewerBacklog
+	Backlog int
+
+	mtx   sync.Mutex
+	joins map[string]hubJoin
+}
+
+// what a join token gets a viewer into
+type hubJoin struct {
+	session *Session
+	mode    string
+}
+
+func NewHub() *Hub {
+	return &Hub{joins: make(map[string]hubJoin)}
+}
+
+func (h *Hub) backlog() int {
+	if h.Backlog == 0 {
+		return DefaultViewerBacklog
+	}
+	return h.Backlog
+}
+
+func (h *Hub) add(session *Session) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.joins[session.watchToken] = hubJoin{session: session, mode: ViewerWatch}
+	h.joins[session.pairToken] = hubJoin{session: session, mode: ViewerPair}
+}
+
+func (h *Hub) remove(tokens ...string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, token := range tokens {
+		delete(h.joins, token)
+	}
+}
+
+// the session that token joins, and how, or nil if there isn't one
+func (h *Hub) get(token string) (*Session, string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	join, ok := h.joins[token]
+	if ok == false {
+		return nil, ""
+	}
+	return join.session, join.mode
+}
+
+// talk to a client that's joining a running instance, with one of the tokens the instance
+// was welcomed with. The client's hello is like any other, plus the token. log is where the
+// client is logged until it joins, nil for ProcLog
+func JoinInstance(ws *websocket.Conn, hub *Hub, log *slog.Logger) {
+	if log == nil {
+		log = ProcLog
+	}
+	var mtx sync.Mutex
+	reject := func(err *ProtocolError) {
+		log.Info("protocol error", "err", err)
+		writeMessage(ws, &mtx, nil, errorMessage(err))
+		shutdownWs(ws, &mtx)
+	}
+
+	msg, err := readProcMessage(ws)
+	if err != nil {
+		log.Info("client left before saying hello", "err", err)
+		shutdownWs(ws, &mtx)
+		return
+	}
+	if msg.Category != "hello" {
+		reject(protocolErrorf(ErrUnexpectedMessage, "hello has to be the first message"))
+		return
+	}
+	welcome, perr := negotiate(msg.Body, "")
+	if perr != nil {
+		reject(perr)
+		return
+	}
+	hello, _ := parseHello(msg.Body)
+	session, mode := hub.get(hello.Join)
+	if session == nil {
+		reject(protocolErrorf(ErrJoinFailed, "there's no running program to join"))
+		return
+	}
+
+	welcome.Instance = session.id
+	welcome.Mode = mode
+	body, _ := json.Marshal(welcome)
+	writeMessage(ws, &mtx, nil, ProcMessage{Category: "welcome", Body: string(body)})
+	session.serve(ws, &mtx, slices.Contains(welcome.Features, "base64"), 0, mode)
+}
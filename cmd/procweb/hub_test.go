@@ -0,0 +1,213 @@
+package procweb
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// start a program that can be shared, returning its owner's socket
+func startShared(t *testing.T, hub *Hub, config InstanceConfig) (*websocket.Conn, Welcome) {
+	t.Helper()
+	config.Hub = hub
+	config.Language = Languages["luajit"]
+	ourSock, instanceSock := createSockets()
+	go NewInstance(instanceSock, config)
+	welcome := helloInstance(t, ourSock, Hello{Version: 1, Features: []string{"exit", "seq", "viewers"}})
+	if welcome.Watch == "" || welcome.Pair == "" || welcome.Watch == welcome.Pair {
+		t.Fatalf("expected join tokens, got %+v", welcome)
+	}
+	writeProcMessage(ourSock, ProcMessage{Category: "EOF", Body: "code"})
+	// the tokens only work once the program has started
+	for {
+		if session, _ := hub.get(welcome.Watch); session != nil {
+			return ourSock, welcome
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// join a shared program with token
+func joinShared(t *testing.T, hub *Hub, token string) (*websocket.Conn, Welcome) {
+	t.Helper()
+	ourSock, instanceSock := createSockets()
+	go JoinInstance(instanceSock, hub, nil)
+	return ourSock, helloInstance(t, ourSock, Hello{Version: 1, Join: token})
+}
+
+// read from ws until a message of the given category comes
+func readUntil(t *testing.T, ws *websocket.Conn, category string) ProcMessage {
+	t.Helper()
+	for {
+		if msg := readMessage(t, ws); msg.Category == category {
+			return msg
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	hub := NewHub()
+	owner, welcome := startShared(t, hub, InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}})
+	writeProcMessage(owner, ProcMessage{Category: "stdin", Body: "one\n"})
+	readUntil(t, owner, "stdout")
+
+	viewer, joined := joinShared(t, hub, welcome.Watch)
+	if joined.Instance != welcome.Instance || joined.Mode != ViewerWatch || joined.Watch != "" {
+		t.Errorf("bad welcome for a viewer %+v", joined)
+	}
+	// the viewer catches up on what's been kept, and everyone hears that it joined
+	if msg := readMessage(t, viewer); msg.Body != "one\n" || msg.Seq != 2 {
+		t.Errorf("bad replay %+v", msg)
+	}
+	for _, ws := range []*websocket.Conn{owner, viewer} {
+		if msg := readMessage(t, ws); msg.Category != "viewers" || msg.Body != `{"viewers": 1}` {
+			t.Errorf("expected a viewer count, got %+v", msg)
+		}
+	}
+
+	writeProcMessage(viewer, ProcMessage{Category: "stdin", Body: "sneaky\n"})
+	if msg := readMessage(t, viewer); protocolErrorCode(msg) != ErrReadOnly || msg.Seq != 0 {
+		t.Errorf("expected a read_only error just for the viewer, got %+v", msg)
+	}
+	writeProcMessage(owner, ProcMessage{Category: "stdin", Body: "two\n"})
+	writeProcMessage(owner, ProcMessage{Category: "EOF", Body: "stdin"})
+
+	ownerMsgs, viewerMsgs := readRest(t, owner), readRest(t, viewer)
+	if combineCategory(ownerMsgs, "stdout").Body != "two\n" || combineCategory(viewerMsgs, "stdout").Body != "two\n" {
+		t.Errorf("the owner and viewer saw different output: %v and %v", ownerMsgs, viewerMsgs)
+	}
+	exitStatus(t, ownerMsgs)
+	exitStatus(t, viewerMsgs)
+	if session, _ := hub.get(welcome.Watch); session != nil {
+		t.Errorf("the program ended but can still be joined")
+	}
+}
+
+func TestPair(t *testing.T) {
+	hub := NewHub()
+	owner, welcome := startShared(t, hub, InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}})
+	pair, joined := joinShared(t, hub, welcome.Pair)
+	if joined.Mode != ViewerPair {
+		t.Errorf("bad welcome for a pair %+v", joined)
+	}
+	readUntil(t, owner, "viewers")
+
+	writeProcMessage(pair, ProcMessage{Category: "stdin", Body: "from the pair\n"})
+	if msg := readUntil(t, owner, "stdout"); msg.Body != "from the pair\n" {
+		t.Errorf("bad output %+v", msg)
+	}
+	// the pair leaving doesn't stop the program
+	pair.Close()
+	if msg := readUntil(t, owner, "viewers"); msg.Body != `{"viewers": 0}` {
+		t.Errorf("expected the viewer count to drop, got %+v", msg)
+	}
+	writeProcMessage(owner, ProcMessage{Category: "EOF", Body: "stdin"})
+	if exit := exitStatus(t, readRest(t, owner)); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+}
+
+// a fake program that prints a lot as soon as it's told to
+func fakeFlood(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	bufio.NewReader(stdin).ReadString('\n')
+	line := strings.Repeat("flood ", 1000) + "\n"
+	for range 2 << 10 {
+		_, err := io.WriteString(stdout, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSlowViewer(t *testing.T) {
+	hub := NewHub()
+	hub.Backlog = 4
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeFlood}, Limits: Limits{Output: 1 << 30, Truncate: 1 << 30}}
+	owner, welcome := startShared(t, hub, config)
+	viewer, _ := joinShared(t, hub, welcome.Watch)
+	readUntil(t, owner, "viewers")
+
+	// the viewer doesn't read anything, but the program doesn't wait for it
+	writeProcMessage(owner, ProcMessage{Category: "stdin", Body: "go\n"})
+	msgs := readRest(t, owner)
+	if count := combineCategory(msgs, "viewers").Body; count != `{"viewers": 0}` {
+		t.Errorf("expected the viewer to be dropped, got %s", count)
+	}
+	if exit := exitStatus(t, msgs); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+	// and the viewer is told why it was dropped
+	if msg := readUntil(t, viewer, "error"); protocolErrorCode(msg) != ErrTooSlow {
+		t.Errorf("expected a too_slow error, got %+v", msg)
+	}
+}
+
+// an owner that stops reading holds up its program, but not the rest of the session
+func TestSlowOwner(t *testing.T) {
+	hub := NewHub()
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeFlood}, Limits: Limits{Output: 1 << 30, Truncate: 1 << 30}}
+	owner, welcome := startShared(t, hub, config)
+	session, _ := hub.get(welcome.Watch)
+	writeProcMessage(owner, ProcMessage{Category: "stdin", Body: "go\n"})
+	eventually(t, "the program never waited for its owner", func() bool {
+		session.mtx.Lock()
+		defer session.mtx.Unlock()
+		return session.conn != nil && len(session.conn.pending) >= ownerBacklog
+	})
+
+	// a viewer can still join while the owner's behind
+	viewer, _ := joinShared(t, hub, welcome.Watch)
+	readUntil(t, viewer, "viewers")
+	viewer.Close()
+
+	if exit := exitStatus(t, readRest(t, owner)); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+}
+
+func TestSpammingViewer(t *testing.T) {
+	hub := NewHub()
+	hub.Backlog = 4
+	owner, welcome := startShared(t, hub, InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}})
+	viewer, _ := joinShared(t, hub, welcome.Watch)
+	readUntil(t, owner, "viewers")
+
+	// a watcher that never reads keeps sending input, and every one gets it an error back,
+	// until its connection backs up
+	go func() {
+		for {
+			err := writeProcMessage(viewer, ProcMessage{Category: "stdin", Body: "let me in\n"})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// the owner's program keeps going, and the watcher gets dropped
+	for dropped := false; dropped == false; {
+		writeProcMessage(owner, ProcMessage{Category: "stdin", Body: "tick\n"})
+		for msg := readMessage(t, owner); msg.Category != "stdout"; msg = readMessage(t, owner) {
+			dropped = dropped || (msg.Category == "viewers" && msg.Body == `{"viewers": 0}`)
+		}
+	}
+	writeProcMessage(owner, ProcMessage{Category: "EOF", Body: "stdin"})
+	if exit := exitStatus(t, readRest(t, owner)); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+	viewer.Close()
+}
+
+func TestJoinFailed(t *testing.T) {
+	ws, instanceSock := createSockets()
+	go JoinInstance(instanceSock, NewHub(), nil)
+	writeProcMessage(ws, ProcMessage{Category: "hello", Body: `{"version": 1, "join": "nope"}`})
+	msgs := readRest(t, ws)
+	if len(msgs) != 1 || protocolErrorCode(msgs[0]) != ErrJoinFailed {
+		t.Errorf("expected a join_failed error, got %v", msgs)
+	}
+}
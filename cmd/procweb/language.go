@@ -0,0 +1,126 @@
+package procweb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// a Language describes how to build and run programs written in one programming language
+type Language struct {
+	Name string
+	// the file the program's source is written to, and that it starts from
+	FileName string
+	// code that goes before the program, for example to turn off output buffering.
+	// Programs on a terminal don't get it, since they only need it for pipes
+	Prelude string
+	// the command that compiles the program, nil if the language doesn't need one
+	Build []string
+	// the command that runs the program
+	Run []string
+	// the docker image that the program runs in
+	Image string
+}
+
+// the language used when a client doesn't ask for one
+const DefaultLanguage string = "luajit"
+
+// every language that code instances can run, by name
+var Languages = map[string]Language{
+	"lua": {
+		Name:     "lua",
+		FileName: "main.lua",
+		Prelude:  "io.stdout:setvbuf(\"no\")\nio.stderr:setvbuf(\"no\")\n",
+		Run:      []string{"lua5.4", "main.lua"},
+		Image:    "runlua:latest",
+	},
+	"luajit": {
+		Name:     "luajit",
+		FileName: "main.lua",
+		Prelude:  "io.stdout:setvbuf(\"no\")\nio.stderr:setvbuf(\"no\")\n",
+		Run:      []string{"luajit", "main.lua"},
+		Image:    "runlua:latest",
+	},
+	"python": {
+		Name:     "python",
+		FileName: "main.py",
+		Run:      []string{"python3", "-u", "main.py"},
+		Image:    "runpython:latest",
+	},
+	"javascript": {
+		Name:     "javascript",
+		FileName: "main.js",
+		Run:      []string{"node", "main.js"},
+		Image:    "runjavascript:latest",
+	},
+	"c": {
+		Name:     "c",
+		FileName: "main.c",
+		// #line keeps compiler messages pointing at the student's line numbers
+		Prelude: "#include <stdio.h>\n" +
+			"__attribute__((constructor)) static void owb_unbuffer(void) { setvbuf(stdout, NULL, _IONBF, 0); }\n" +
+			"#line 1 \"main.c\"\n",
+		Build: []string{"cc", "-O2", "-Wall", "-o", "main", "main.c"},
+		Run:   []string{"./main"},
+		Image: "runc:latest",
+	},
+}
+
+// find a language by name. An empty name means DefaultLanguage
+func LookupLanguage(name string) (Language, error) {
+	if name == "" {
+		name = DefaultLanguage
+	}
+	lang, ok := Languages[name]
+	if ok == false {
+		return Language{}, fmt.Errorf("unsupported language: %s", name)
+	}
+	return lang, nil
+}
+
+// quote a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// join a command into a single POSIX shell command line
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, v := range args {
+		quoted = append(quoted, shellQuote(v))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// the command that builds (if needed) and then runs the program
+func (l Language) Command() []string {
+	if len(l.Build) == 0 {
+		return l.Run
+	}
+	return []string{"/bin/sh", "-c", shellJoin(l.Build) + " && exec " + shellJoin(l.Run)}
+}
+
+// the language with its program starting from entrypoint instead of FileName
+func (l Language) WithEntrypoint(entrypoint string) Language {
+	if entrypoint == "" || entrypoint == l.FileName {
+		return l
+	}
+	replace := func(args []string) []string {
+		if args == nil {
+			return nil
+		}
+		result := make([]string, len(args))
+		for i, v := range args {
+			if v == l.FileName {
+				v = entrypoint
+			}
+			result[i] = v
+		}
+		return result
+	}
+	// the prelude can name the file too, like C's #line
+	l.Prelude = strings.ReplaceAll(l.Prelude, `"`+l.FileName+`"`, `"`+entrypoint+`"`)
+	l.Build = replace(l.Build)
+	l.Run = replace(l.Run)
+	l.FileName = entrypoint
+	return l
+}
@@ -0,0 +1,340 @@
+package procweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Limits caps the resources that one instance's program can use. A zero field means no limit
+type Limits struct {
+	// CPU time the program can use
+	CPUTime time.Duration
+	// how long the program can run for, including time spent waiting for input
+	WallClock time.Duration
+	// memory the program can use, in bytes
+	Memory int64
+	// how many processes the program can run at once
+	Processes int64
+	// how much the program can write to stdout and stderr combined, in bytes
+	Output int64
+	// how much of the program's output is sent to the client, in bytes. Output past this is
+	// dropped, but the program carries on until it hits the Output limit
+	Truncate int64
+}
+
+// the limits used when the server isn't configured otherwise
+var DefaultLimits = Limits{
+	CPUTime:   10 * time.Second,
+	WallClock: 10 * time.Minute,
+	Memory:    256 << 20,
+	Processes: 32,
+	Output:    1 << 20,
+	Truncate:  256 << 10,
+}
+
+// LimitPolicy decides the limits for each instance. Exercises can override Default,
+// but only up to Max
+type LimitPolicy struct {
+	Default Limits
+	Max     Limits
+}
+
+// the names of the limits in query strings and flags
+var limitNames = []string{"cpuTime", "wallClock", "memory", "processes", "output", "truncate"}
+
+// apply overrides from a query string like wallClock=2s&memory=67108864 to l
+func (l Limits) Override(q url.Values) (Limits, error) {
+	for _, name := range limitNames {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+
+		var err error
+		switch name {
+		case "cpuTime":
+			l.CPUTime, err = time.ParseDuration(v)
+		case "wallClock":
+			l.WallClock, err = time.ParseDuration(v)
+		case "memory":
+			l.Memory, err = strconv.ParseInt(v, 10, 64)
+		case "processes":
+			l.Processes, err = strconv.ParseInt(v, 10, 64)
+		case "output":
+			l.Output, err = strconv.ParseInt(v, 10, 64)
+		case "truncate":
+			l.Truncate, err = strconv.ParseInt(v, 10, 64)
+		}
+		if err != nil {
+			return l, fmt.Errorf("bad %s limit: %w", name, err)
+		}
+	}
+
+	if l.CPUTime < 0 || l.WallClock < 0 || l.Memory < 0 || l.Processes < 0 || l.Output < 0 || l.Truncate < 0 {
+		return l, errors.New("limits can't be negative")
+	}
+	return l, nil
+}
+
+// the smaller of two limits, where zero means unlimited
+func minLimit[T time.Duration | int64](a T, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// lower every limit in l to at most the matching limit in max
+func (l Limits) Clamp(max Limits) Limits {
+	return Limits{
+		CPUTime:   minLimit(l.CPUTime, max.CPUTime),
+		WallClock: minLimit(l.WallClock, max.WallClock),
+		Memory:    minLimit(l.Memory, max.Memory),
+		Processes: minLimit(l.Processes, max.Processes),
+		Output:    minLimit(l.Output, max.Output),
+		Truncate:  minLimit(l.Truncate, max.Truncate),
+	}
+}
+
+// the limits for an instance whose exercise asked for the overrides in q
+func (p LimitPolicy) Resolve(q url.Values) (Limits, error) {
+	l, err := p.Default.Override(q)
+	if err != nil {
+		return Limits{}, err
+	}
+	return l.Clamp(p.Max), nil
+}
+
+// an error if any default limit is over its maximum, since Resolve would quietly lower it
+func (p LimitPolicy) Check() error {
+	if p.Default.Clamp(p.Max) != p.Default {
+		return fmt.Errorf("default limits %s are over the maximum limits %s", &p.Default, &p.Max)
+	}
+	return nil
+}
+
+// Limits can be set from a command line flag, as comma separated overrides like
+// wallClock=2s,memory=67108864
+func (l *Limits) Set(s string) error {
+	q, err := url.ParseQuery(strings.ReplaceAll(s, ",", "&"))
+	if err != nil {
+		return err
+	}
+	*l, err = l.Override(q)
+	return err
+}
+
+func (l *Limits) String() string {
+	if l == nil {
+		return ""
+	}
+	return fmt.Sprintf("cpuTime=%s,wallClock=%s,memory=%d,processes=%d,output=%d,truncate=%d",
+		l.CPUTime, l.WallClock, l.Memory, l.Processes, l.Output, l.Truncate)
+}
+
+// a human readable size, like 64 KiB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%d GiB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%d MiB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%d KiB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// CPU time rlimits are in whole seconds, so round up
+func cpuSeconds(d time.Duration) uint64 {
+	return uint64((d + time.Second - 1) / time.Second)
+}
+
+// enforcing limits
+// =====================================
+
+// the kinds of limit that can stop a program
+const (
+	LimitKindWall   = "wall"
+	LimitKindCPU    = "cpu"
+	LimitKindMemory = "memory"
+	LimitKindOutput = "output"
+)
+
+// remembers the first limit that stopped an instance's program
+type limitTracker struct {
+	mtx sync.Mutex
+	// one of the LimitKind constants
+	kind string
+	// the limit in words, for the client
+	reason string
+}
+
+// record that the program went over a limit and stop it
+func (t *limitTracker) exceed(kind string, reason string, cancel func()) {
+	t.mtx.Lock()
+	if t.kind == "" {
+		t.kind = kind
+		t.reason = reason
+	}
+	t.mtx.Unlock()
+	cancel()
+}
+
+// the kind of limit that stopped the program and the limit in words, or "" if none did
+func (t *limitTracker) get() (string, string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.kind, t.reason
+}
+
+// ExitError is returned by runners that don't use os/exec when the program exits with a
+// non-zero status
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// LimitError is returned by runners that can tell which limit stopped the program
+type LimitError struct {
+	// one of the LimitKind constants
+	Kind   string
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// the LimitError for a program that went over its memory limit
+func memoryLimitError(limits Limits) *LimitError {
+	return &LimitError{Kind: LimitKindMemory, Reason: fmt.Sprintf("memory limit exceeded (%s)", formatBytes(limits.Memory))}
+}
+
+// SignalError is returned by runners that go through an init process when a signal killed
+// the program. The init exits with 128+signal, which is only a signal when the runner can
+// tell it apart from the program exiting with that status itself
+type SignalError struct {
+	Signal syscall.Signal
+}
+
+func (e *SignalError) Error() string {
+	return "killed by " + signalName(e.Signal)
+}
+
+// the signals a runner has passed on to its program, so that a status of 128+signal after
+// one of them can be put down to it
+type sentSignals struct {
+	mtx  sync.Mutex
+	sent []syscall.Signal
+}
+
+func (s *sentSignals) add(sig syscall.Signal) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sent = append(s.sent, sig)
+}
+
+// the error for a program that exited with a non-zero status code
+func (s *sentSignals) exitError(code int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, sig := range s.sent {
+		if code == 128+int(sig) {
+			return &SignalError{Signal: sig}
+		}
+	}
+	return &ExitError{Code: code}
+}
+
+// the signal that killed a program, based on the error from running it. An exit status
+// of 128+signal is just a status, since programs can exit with it themselves
+func exitSignal(err error) (syscall.Signal, bool) {
+	var signalErr *SignalError
+	if errors.As(err, &signalErr) {
+		return signalErr.Signal, true
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && status.Signaled() {
+			return status.Signal(), true
+		}
+	}
+	return 0, false
+}
+
+// the limit that a program hit, judging by how it exited and what it used, or nil if it
+// didn't hit one. Runners that can tell which limit stopped the program say so with a
+// LimitError, otherwise only the CPU limit can be told from its signals: SIGXCPU at the
+// limit, then SIGKILL for programs that ignore it. Other things send SIGKILL too, so it only
+// counts once the CPU time is up
+func exitLimit(err error, limits Limits, usage Usage) *LimitError {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr
+	}
+
+	sig, ok := exitSignal(err)
+	if ok == false || limits.CPUTime == 0 {
+		return nil
+	}
+	cpuLimit := &LimitError{Kind: LimitKindCPU, Reason: fmt.Sprintf("CPU time limit exceeded (%s)", limits.CPUTime)}
+	switch {
+	case sig == syscall.SIGXCPU:
+		return cpuLimit
+	case sig == syscall.SIGKILL && usage.CPUTime >= limits.CPUTime:
+		return cpuLimit
+	}
+	return nil
+}
+
+// forward messages from in to out, stopping the program once more than limit bytes of output
+// have gone through. out is not closed
+func limitOutput(ctx context.Context,
+	in chan ProcMessage,
+	out chan ProcMessage,
+	limit int64,
+	tracker *limitTracker,
+	cancelRun func(),
+) {
+	var total int64
+	for msg := range in {
+		total += int64(len(msg.Body))
+		over := limit != 0 && total > limit
+		if over {
+			// send what fits, without splitting a character
+			msg.Body = truncateRunes(msg.Body, len(msg.Body)-int(total-limit))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- msg:
+		}
+
+		if over {
+			tracker.exceed(LimitKindOutput, fmt.Sprintf("output limit exceeded (%s)", formatBytes(limit)), cancelRun)
+			// keep draining so the output scanners can finish
+			for range in {
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package procweb
+
+import (
+	"time"
+
+	"gihub.com/scrmbld/OpenWorkbook/cmd/metrics"
+)
+
+// metrics
+// =====================================
+
+// how a run ended, for counting runs by it
+const (
+	// the program exited with status 0
+	reasonNormal = "normal"
+	// the program exited with another status, or a signal it didn't get from us killed it
+	reasonError = "error"
+	// the program ran out of wall clock or CPU time
+	reasonTimeout = "timeout"
+	// another limit stopped the program, like its memory or output
+	reasonLimit = "limit"
+	// the client had the program killed, stopped it with a signal like ^C, or left it
+	reasonKilled = "killed"
+	// the program never got to run, like when it waited too long for its turn
+	reasonNeverRan = "never_ran"
+)
+
+// buckets for how long programs run in seconds. Most are over in a moment, but interactive
+// ones wait on their students
+var runBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// a Metrics counts how instances and their programs are doing.
+// A nil Metrics counts nothing
+type Metrics struct {
+	active         *metrics.Gauge
+	runs           *metrics.Counter
+	runDuration    *metrics.Histogram
+	inputBytes     *metrics.Counter
+	outputBytes    *metrics.Counter
+	containerStart *metrics.Histogram
+}
+
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		active:         reg.Gauge("openworkbook_instances_active", "Programs that have been started and haven't finished, queued ones included."),
+		runs:           reg.Counter("openworkbook_runs_total", "Programs that finished, by language and how they ended (normal, error, timeout, limit, killed, never_ran).", "language", "reason"),
+		runDuration:    reg.Histogram("openworkbook_run_duration_seconds", "How long programs ran for, by language, not counting time in the queue.", runBuckets, "language"),
+		inputBytes:     reg.Counter("openworkbook_program_input_bytes_total", "Bytes of input given to programs."),
+		outputBytes:    reg.Counter("openworkbook_program_output_bytes_total", "Bytes of output from programs, up to their output limits.", "stream"),
+		containerStart: reg.Histogram("openworkbook_container_start_seconds", "How long it took to get a program's container going, cold for a new container or warm for one from the pool.", metrics.DefaultBuckets, "start"),
+	}
+}
+
+func (m *Metrics) started() {
+	if m == nil {
+		return
+	}
+	m.active.Add(1)
+}
+
+// a run is over, after running for wall if it ran at all
+func (m *Metrics) finished(language string, reason string, wall time.Duration) {
+	if m == nil {
+		return
+	}
+	m.active.Add(-1)
+	m.runs.Inc(language, reason)
+	if reason != reasonNeverRan {
+		m.runDuration.Observe(wall.Seconds(), language)
+	}
+}
+
+func (m *Metrics) input(msg []byte) {
+	if m == nil {
+		return
+	}
+	m.inputBytes.Add(float64(len(msg)))
+}
+
+func (m *Metrics) output(msg ProcMessage) {
+	if m == nil || (msg.Category != "stdout" && msg.Category != "stderr") {
+		return
+	}
+	m.outputBytes.Add(float64(len(msg.Body)), msg.Category)
+}
+
+// a container took since start to get going. how is "cold" or "warm"
+func (m *Metrics) containerStarted(how string, since time.Time) {
+	if m == nil {
+		return
+	}
+	m.containerStart.Observe(time.Since(since).Seconds(), how)
+}
+
+// how a run with status ended, as one of the reasons above. limitKind is the kind of limit
+// that stopped it, "" if none did. signalled says whether the client sent the program a
+// signal, in which case the program failing is put down to it, whether the signal killed
+// the program or the program exited over it, like python does on ^C
+func exitReason(status ExitStatus, limitKind string, killed bool, signalled bool) string {
+	switch {
+	case killed:
+		return reasonKilled
+	case limitKind == LimitKindWall || limitKind == LimitKindCPU:
+		return reasonTimeout
+	case limitKind != "":
+		return reasonLimit
+	case status.Code == 0:
+		return reasonNormal
+	case signalled:
+		return reasonKilled
+	default:
+		return reasonError
+	}
+}
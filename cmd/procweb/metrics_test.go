@@ -0,0 +1,62 @@
+package procweb
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gihub.com/scrmbld/OpenWorkbook/cmd/metrics"
+)
+
+func TestRunMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewMetrics(reg)
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"], Metrics: m}
+	_, err := RunBatch(context.Background(), config, Program{Files: NewWorkspace()}, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Runner = FakeRunner{Program: fakeForever}
+	config.Limits = Limits{WallClock: 50 * time.Millisecond}
+	_, err = RunBatch(context.Background(), config, Program{Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Runner = FakeRunner{Program: fakeSpam}
+	config.Limits = Limits{Output: 100}
+	_, err = RunBatch(context.Background(), config, Program{Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a program the client stops with ^C didn't fail on its own
+	config.Runner = FakeRunner{Program: fakeForever}
+	config.Limits = Limits{}
+	run, err := StartRun(context.Background(), config, Program{Files: NewWorkspace()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Signal(syscall.SIGINT)
+	if result := collectBatch(run, ""); result.Exit.Code == 0 {
+		t.Errorf("the program wasn't stopped %+v", result.Exit)
+	}
+
+	var b strings.Builder
+	reg.Write(bufio.NewWriter(&b))
+	for _, line := range []string{
+		`openworkbook_instances_active 0`,
+		`openworkbook_runs_total{language="luajit",reason="normal"} 1`,
+		`openworkbook_runs_total{language="luajit",reason="timeout"} 1`,
+		`openworkbook_runs_total{language="luajit",reason="limit"} 1`,
+		`openworkbook_runs_total{language="luajit",reason="killed"} 1`,
+		`openworkbook_run_duration_seconds_count{language="luajit"} 4`,
+		`openworkbook_program_input_bytes_total 3`,
+		`openworkbook_program_output_bytes_total{stream="stdout"} 103`,
+	} {
+		if strings.Contains(b.String(), line+"\n") == false {
+			t.Errorf("expected %q in the metrics:\n%s", line, b.String())
+		}
+	}
+}
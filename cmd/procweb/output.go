@@ -0,0 +1,173 @@
+package procweb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// shaping output for the client
+// =====================================
+
+// how long to wait for more output before sending what a program has printed so far. Long
+// enough to gather up a print loop's writes, short enough that nobody notices
+const coalesceWindow = 5 * time.Millisecond
+
+// the most output that's gathered up into one message, in bytes
+const maxCoalescedSize = 16 << 10
+
+// join up messages of the same category that arrive within window of the first, up to
+// maxSize bytes, so that a program printing a little at a time doesn't cost a message per
+// write. Each joined message keeps the time of its first part
+func coalesceOutput(ctx context.Context, in chan ProcMessage, window time.Duration, maxSize int) chan ProcMessage {
+	out := make(chan ProcMessage, 8)
+	go func() {
+		defer close(out)
+		timer := time.NewTimer(window)
+		timer.Stop()
+		defer timer.Stop()
+
+		var pending *ProcMessage
+		flush := func() bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case out <- *pending:
+			}
+			pending = nil
+			return true
+		}
+		for {
+			// only wait on the window while there's something to send
+			var deadline <-chan time.Time
+			if pending != nil {
+				deadline = timer.C
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-deadline:
+				if flush() == false {
+					return
+				}
+			case msg, ok := <-in:
+				if ok == false {
+					if pending != nil {
+						flush()
+					}
+					return
+				}
+				if pending != nil && (msg.Category != pending.Category || len(pending.Body)+len(msg.Body) > maxSize) {
+					if flush() == false {
+						return
+					}
+				}
+				if pending == nil {
+					pending = &msg
+					timer.Reset(window)
+					continue
+				}
+				pending.Body += msg.Body
+			}
+		}
+	}()
+	return out
+}
+
+// the length of b without the incomplete UTF-8 character it ends with, if it ends with one.
+// Bytes that can't be part of a character don't count as incomplete, so they're kept
+func completeRunes(b []byte) int {
+	// a character's first byte is at most UTFMax-1 bytes before the end
+	for i := len(b) - 1; i >= 0 && i >= len(b)-(utf8.UTFMax-1); i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// the longest prefix of s that's at most n bytes and doesn't end part way through a
+// UTF-8 character
+func truncateRunes(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	// find the start of the character at n, and leave it out if it doesn't fit
+	for i := n; i >= 0 && i > n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			_, size := utf8.DecodeRuneInString(s[i:])
+			if i+size > n {
+				return s[:i]
+			}
+			break
+		}
+	}
+	return s[:n]
+}
+
+// the encoding of message bodies that hold bytes rather than text
+const EncodingBase64 = "base64"
+
+// base64 encode the body of an output message if it isn't valid UTF-8, so that it gets to
+// the client as the program wrote it
+func encodeOutput(msg ProcMessage) ProcMessage {
+	if (msg.Category != "stdout" && msg.Category != "stderr") || utf8.ValidString(msg.Body) {
+		return msg
+	}
+	msg.Body = base64.StdEncoding.EncodeToString([]byte(msg.Body))
+	msg.Encoding = EncodingBase64
+	return msg
+}
+
+// the message that takes the place of output past the truncation limit
+func truncatedMessage(limit int64) ProcMessage {
+	return ProcMessage{Category: "truncated", Body: fmt.Sprintf("[output truncated after %s]", formatBytes(limit))}
+}
+
+// forward messages from in to out until limit bytes of output have gone through. The first
+// time output has to be dropped, say so with a "truncated" message. Everything after that
+// is dropped, but still read so the program isn't held up. Returns how many bytes were
+// dropped. out is not closed
+func truncateOutput(ctx context.Context, in chan ProcMessage, out chan ProcMessage, limit int64) int64 {
+	send := func(msg ProcMessage) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case out <- msg:
+			return true
+		}
+	}
+
+	var total, dropped int64
+	truncated := false
+	for msg := range in {
+		size := int64(len(msg.Body))
+		if limit == 0 || total+size <= limit {
+			total += size
+			if send(msg) == false {
+				return dropped
+			}
+			continue
+		}
+
+		// send what fits, without splitting a character
+		msg.Body = truncateRunes(msg.Body, int(limit-total))
+		total = limit
+		dropped += size - int64(len(msg.Body))
+		if msg.Body != "" && send(msg) == false {
+			return dropped
+		}
+		if truncated == false {
+			truncated = true
+			if send(truncatedMessage(limit)) == false {
+				return dropped
+			}
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,222 @@
+package procweb
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCoalesceOutput(t *testing.T) {
+	in := make(chan ProcMessage)
+	out := coalesceOutput(context.Background(), in, time.Second, 8)
+	go func() {
+		for _, msg := range []ProcMessage{
+			{Category: "stdout", Body: "a", Time: 1},
+			{Category: "stdout", Body: "b", Time: 2},
+			{Category: "stderr", Body: "c", Time: 3},
+			{Category: "stdout", Body: "defgh", Time: 4},
+			{Category: "stdout", Body: "ijkl", Time: 5},
+		} {
+			in <- msg
+		}
+		close(in)
+	}()
+
+	var got []ProcMessage
+	for msg := range out {
+		got = append(got, msg)
+	}
+	want := []ProcMessage{
+		{Category: "stdout", Body: "ab", Time: 1},
+		{Category: "stderr", Body: "c", Time: 3},
+		{Category: "stdout", Body: "defgh", Time: 4},
+		{Category: "stdout", Body: "ijkl", Time: 5},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %v, got %v", want[i], got[i])
+		}
+	}
+
+	// output doesn't wait for more than the window
+	in = make(chan ProcMessage)
+	out = coalesceOutput(context.Background(), in, 10*time.Millisecond, 1024)
+	in <- ProcMessage{Category: "stdout", Body: "> "}
+	select {
+	case msg := <-out:
+		if msg.Body != "> " {
+			t.Errorf("bad message %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("a prompt waited for more output")
+	}
+	close(in)
+}
+
+func TestTruncateOutput(t *testing.T) {
+	in := make(chan ProcMessage, 8)
+	out := make(chan ProcMessage, 8)
+	for _, body := range []string{"abc", "defg", "hi", "jk"} {
+		in <- ProcMessage{Category: "stdout", Body: body}
+	}
+	close(in)
+	dropped := truncateOutput(context.Background(), in, out, 5)
+	close(out)
+
+	var bodies []string
+	for msg := range out {
+		bodies = append(bodies, msg.Body)
+	}
+	want := "abc de [output truncated after 5 bytes]"
+	if strings.Join(bodies, " ") != want || dropped != 6 {
+		t.Errorf("want %q with 6 dropped, got %q with %d", want, bodies, dropped)
+	}
+}
+
+func TestTruncatedInstance(t *testing.T) {
+	config := InstanceConfig{
+		Runner:   FakeRunner{Program: fakeSpam},
+		Language: Languages["luajit"],
+		Limits:   Limits{Output: 64 << 10, Truncate: 1 << 10},
+	}
+	for _, features := range []string{`["exit", "truncated"]`, `["exit"]`} {
+		msgs, err := runInstanceMessages(config, []ProcMessage{
+			{Category: "hello", Body: `{"version": 1, "features": ` + features + `}`},
+			{Category: "code", Body: "while true do print('spam spam spam') end"},
+			{Category: "EOF", Body: "code"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		notice := "[output truncated after 1 KiB]"
+		if combineCategory(msgs, "truncated").Body+combineCategory(msgs, "stderr").Body != notice &&
+			combineCategory(msgs, "stderr").Body != "\n"+notice+"\n" {
+			t.Errorf("expected a truncation notice with %s, got %v", features, msgs)
+		}
+		if stdout := combineCategory(msgs, "stdout").Body; len(stdout) != 1<<10 {
+			t.Errorf("expected 1 KiB of output, got %d bytes", len(stdout))
+		}
+		// the program still runs until it hits the output limit
+		exit := exitStatus(t, msgs)
+		if exit.Limit != "output limit exceeded (64 KiB)" || exit.OutputDropped != 63<<10 {
+			t.Errorf("bad exit %+v", exit)
+		}
+	}
+}
+
+func TestCompleteRunes(t *testing.T) {
+	for s, want := range map[string]int{
+		"":              0,
+		"LÖVE":          5,
+		"L\xc3":         1,
+		"\xe2\x82":      0,
+		"a\xe2\x82\xac": 4,
+		"a\xf0\x9f\x98": 1,
+		// not the start of anything, so there's no point waiting for more
+		"a\x80\x80\x80\x80": 5,
+		"a\xff":             2,
+	} {
+		if got := completeRunes([]byte(s)); got != want {
+			t.Errorf("%q: want %d, got %d", s, want, got)
+		}
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"LÖVE", 10, "LÖVE"},
+		{"LÖVE", 3, "LÖ"},
+		{"LÖVE", 2, "L"},
+		{"LÖVE", 1, "L"},
+		{"€", 2, ""},
+		{"\x80\x80\x80\x80\x80", 2, "\x80\x80"},
+	} {
+		if got := truncateRunes(c.s, c.n); got != c.want {
+			t.Errorf("%q cut at %d: want %q, got %q", c.s, c.n, c.want, got)
+		}
+	}
+}
+
+func TestOutScannerRunes(t *testing.T) {
+	reader, writer := io.Pipe()
+	outChan := make(chan ProcMessage, 8)
+	go outScanner(context.Background(), func() {}, reader, outChan, "stdout", ProcLog)
+	go func() {
+		defer writer.Close()
+		// every Ö and € is split between writes
+		for _, s := range []string{"L\xc3", "\x96VE \xe2", "\x82", "\xac", "\xff"} {
+			writer.Write([]byte(s))
+		}
+	}()
+
+	var out strings.Builder
+	for msg := range outChan {
+		out.WriteString(msg.Body)
+		if strings.HasSuffix(msg.Body, "\xff") == false && utf8.ValidString(msg.Body) == false {
+			t.Errorf("a character was split: %q", msg.Body)
+		}
+	}
+	if out.String() != "LÖVE €\xff" {
+		t.Errorf("bad output %q", out.String())
+	}
+}
+
+func TestEncodeOutput(t *testing.T) {
+	text := ProcMessage{Category: "stdout", Body: "LÖVE"}
+	if encodeOutput(text) != text {
+		t.Errorf("text was encoded")
+	}
+	if notice := truncatedMessage(1); encodeOutput(notice) != notice {
+		t.Errorf("a notice was encoded")
+	}
+	bin := encodeOutput(ProcMessage{Category: "stderr", Body: "\x00\xff"})
+	if bin.Encoding != EncodingBase64 || bin.Body != "AP8=" {
+		t.Errorf("bad encoding %+v", bin)
+	}
+}
+
+// a fake program that prints bytes that aren't UTF-8
+func fakeBinary(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	_, err := stdout.Write([]byte("\x89PNG\r\n"))
+	return err
+}
+
+func TestBinaryOutput(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeBinary}, Language: Languages["luajit"], PTY: true}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "features": ["exit", "base64"]}`},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := combineCategory(msgs, "stdout")
+	for _, msg := range msgs {
+		if msg.Category == "stdout" && msg.Encoding != EncodingBase64 {
+			t.Errorf("expected base64 output, got %+v", msg)
+		}
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(stdout.Body); string(decoded) != "\x89PNG\r\n" {
+		t.Errorf("bad output %q", stdout.Body)
+	}
+
+	result, err := RunBatch(context.Background(), config, Program{Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(result.Stdout); result.Encoding != EncodingBase64 || string(decoded) != "\x89PNG\r\n" {
+		t.Errorf("bad batch result %+v", result)
+	}
+}
@@ -0,0 +1,488 @@
+package procweb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often the pool checks for old containers, and retries languages whose containers failed to start
+const poolCheckInterval = 5 * time.Second
+
+// what pooled containers run while they wait for a program. It ignores the signals that
+// programs get from the client, since those are sent to every process in the container
+var idleCommand = []string{"/bin/sh", "-c", "trap '' INT TERM; while :; do sleep 3600; done"}
+
+// PoolConfig decides how many idle containers a PoolRunner keeps for each language
+type PoolConfig struct {
+	// idle containers to keep for each language
+	Size int
+	// per-language overrides for Size, by language name. A zero target turns the pool off for that language
+	Targets PoolTargets
+	// idle containers older than this are replaced, so that they pick up rebuilt images. Zero means never
+	MaxAge time.Duration
+	// the limits that pooled containers are created with. Jobs with other CPU, memory or
+	// process limits get a fresh container instead
+	Limits Limits
+}
+
+// how many idle containers to keep for a language
+func (c PoolConfig) target(language string) int {
+	n, ok := c.Targets[language]
+	if ok {
+		return n
+	}
+	return c.Size
+}
+
+// PoolTargets are per-language pool sizes. They can be set from a command line flag, like
+// python=4,c=0
+type PoolTargets map[string]int
+
+func (t *PoolTargets) Set(s string) error {
+	if *t == nil {
+		*t = make(PoolTargets)
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if ok == false {
+			return fmt.Errorf("bad pool target %q, expected language=size", pair)
+		}
+		_, err := LookupLanguage(name)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad pool size for %s: %q", name, value)
+		}
+		(*t)[name] = n
+	}
+	return nil
+}
+
+func (t *PoolTargets) String() string {
+	if t == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*t))
+	for name, n := range *t {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, n))
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// PoolStats describes the pool for one language
+type PoolStats struct {
+	Language string `json:"language"`
+	// how many idle containers the pool tries to keep
+	Target int `json:"target"`
+	// how many idle containers it has right now
+	Idle int `json:"idle"`
+	// instances that got a warm container
+	Hits int64 `json:"hits"`
+	// instances that had to start their own container
+	Misses int64 `json:"misses"`
+	// idle containers replaced for being older than the max age
+	Expired int64 `json:"expired"`
+	// containers that failed to start
+	Failures int64 `json:"failures"`
+}
+
+// an idle container, and the host directory mounted at its /source
+type warmContainer struct {
+	id      string
+	dir     string
+	created time.Time
+}
+
+// PoolRunner
+// =====================================
+
+// PoolRunner keeps pre-started, idle containers for each language, so that instances don't
+// have to wait for docker to start one. A program is copied into an idle container's
+// source directory and run with docker exec. Used containers are removed, and the pool
+// replaces them in the background.
+// Jobs that can't use a pooled container, because the pool for their language is empty or
+// their limits differ from the pool's, fall back to starting their own container
+type PoolRunner struct {
+	docker *DockerRunner
+	config PoolConfig
+
+	mtx   sync.Mutex
+	idle  map[string][]*warmContainer
+	stats map[string]*PoolStats
+
+	// wakes the filler when a container gets used
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// create a PoolRunner that starts containers with docker. Call Start to fill the pool
+func NewPoolRunner(docker *DockerRunner, config PoolConfig) *PoolRunner {
+	p := &PoolRunner{
+		docker: docker,
+		config: config,
+		idle:   make(map[string][]*warmContainer),
+		stats:  make(map[string]*PoolStats),
+		wake:   make(chan struct{}, 1),
+		cancel: func() {},
+		done:   make(chan struct{}),
+	}
+	for name := range Languages {
+		p.stats[name] = &PoolStats{Language: name, Target: config.target(name)}
+	}
+	close(p.done)
+	return p
+}
+
+// start filling the pool in the background. It keeps going until ctx is done or the pool is closed
+func (p *PoolRunner) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	p.mtx.Lock()
+	p.cancel = cancel
+	p.done = done
+	p.mtx.Unlock()
+
+	go func() {
+		defer close(done)
+		p.fill(ctx)
+	}()
+}
+
+// keep every language's pool at its target
+func (p *PoolRunner) fill(ctx context.Context) {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	names := make([]string, 0, len(Languages))
+	for name := range Languages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for {
+		p.expire()
+		for _, name := range names {
+			for p.needs(name) {
+				if ctx.Err() != nil {
+					return
+				}
+				err := p.warm(ctx, name)
+				if err != nil {
+					// try again on the next check rather than hammering docker
+					ProcLog.Error("failed to start pooled container", "language", name, "err", err)
+					p.mtx.Lock()
+					p.stats[name].Failures++
+					p.mtx.Unlock()
+					break
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// whether a language has fewer idle containers than its target
+func (p *PoolRunner) needs(language string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.idle[language]) < p.stats[language].Target
+}
+
+// start an idle container for a language and add it to the pool
+func (p *PoolRunner) warm(ctx context.Context, language string) error {
+	dir, err := os.MkdirTemp("", "pool-")
+	if err != nil {
+		return err
+	}
+	err = chownForContainer(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	config := dockerJobConfig(&Job{Dir: dir, Language: Languages[language], Limits: p.config.Limits})
+	config.Cmd = idleCommand
+	config.AttachStdin = false
+	config.AttachStdout = false
+	config.AttachStderr = false
+	config.OpenStdin = false
+	config.StdinOnce = false
+
+	id, err := p.docker.createContainer(ctx, config)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	c := &warmContainer{id: id, dir: dir, created: time.Now()}
+	err = p.docker.client.start(ctx, id)
+	if err != nil {
+		p.discard(c, ProcLog)
+		return err
+	}
+
+	p.mtx.Lock()
+	p.idle[language] = append(p.idle[language], c)
+	p.mtx.Unlock()
+	return nil
+}
+
+// remove idle containers older than the max age
+func (p *PoolRunner) expire() {
+	if p.config.MaxAge == 0 {
+		return
+	}
+
+	var old []*warmContainer
+	p.mtx.Lock()
+	for name, idle := range p.idle {
+		fresh := idle[:0]
+		for _, c := range idle {
+			if time.Since(c.created) > p.config.MaxAge {
+				old = append(old, c)
+				p.stats[name].Expired++
+			} else {
+				fresh = append(fresh, c)
+			}
+		}
+		p.idle[name] = fresh
+	}
+	p.mtx.Unlock()
+
+	for _, c := range old {
+		p.discard(c, ProcLog)
+	}
+}
+
+// take an idle container that can run job, or nil if there isn't one
+func (p *PoolRunner) take(job *Job) *warmContainer {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	name := job.Language.Name
+	stats, ok := p.stats[name]
+	if ok == false || job.Language.Image != Languages[name].Image {
+		return nil
+	}
+	// cgroup limits and ulimits are fixed when the container is created
+	if job.Limits.CPUTime != p.config.Limits.CPUTime ||
+		job.Limits.Memory != p.config.Limits.Memory ||
+		job.Limits.Processes != p.config.Limits.Processes {
+		stats.Misses++
+		return nil
+	}
+
+	idle := p.idle[name]
+	if len(idle) == 0 {
+		stats.Misses++
+		return nil
+	}
+	c := idle[0]
+	p.idle[name] = idle[1:]
+	stats.Hits++
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return c
+}
+
+// remove a container and its source directory. log is the logger of the run that used the
+// container, or ProcLog for one that was never used
+func (p *PoolRunner) discard(c *warmContainer, log *slog.Logger) {
+	p.docker.remove(c.id, log)
+	err := os.RemoveAll(c.dir)
+	if err != nil {
+		log.Error("failed to remove directory", "dir", c.dir, "err", err)
+	}
+}
+
+func (p *PoolRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	c := p.take(job)
+	if c == nil {
+		return p.docker.Run(ctx, cancel, job)
+	}
+	// containers are never reused, since the last program could have left anything behind
+	defer p.discard(c, job.logger())
+	starting := time.Now()
+
+	// inject the program
+	err := copyTree(job.Dir, c.dir)
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	err = chownForContainer(c.dir)
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	uid, gid := containerUser()
+	execID, conn, err := p.docker.client.exec(ctx, c.id, execConfig{
+		Cmd:          job.Language.Command(),
+		Env:          slices.Concat(containerEnv, termEnv(job)),
+		WorkingDir:   "/source",
+		User:         fmt.Sprintf("%d:%d", uid, gid),
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          job.PTY,
+	})
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	p.docker.Metrics.containerStarted("warm", starting)
+	controlCtx, stopControls := context.WithCancel(ctx)
+	defer stopControls()
+	if job.PTY {
+		endpoint := "/exec/" + execID
+		err = p.docker.client.resize(ctx, endpoint, job.termSize())
+		if err != nil {
+			job.logger().Warn("failed to resize terminal", "err", err)
+		}
+		go applyEach(controlCtx, job.Resize, job.logger(), func(size TermSize) error {
+			return p.docker.client.resize(controlCtx, endpoint, size)
+		})
+	}
+	// docker can only signal a container's init, which here is the idle command. Execs
+	// have no API for it, so signal every process of the container's user from inside
+	var signals sentSignals
+	go applyEach(controlCtx, job.Signals, job.logger(), func(sig syscall.Signal) error {
+		signals.add(sig)
+		return p.docker.client.execDetached(controlCtx, c.id, execConfig{
+			Cmd:  []string{"/bin/sh", "-c", "kill -s " + strings.TrimPrefix(signalName(sig), "SIG") + " -1"},
+			User: fmt.Sprintf("%d:%d", uid, gid),
+		})
+	})
+	defer conn.Close()
+	// unblock reads from the container if the instance gets cancelled. Removing the
+	// container afterwards kills the program
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	streamJob(ctx, cancel, conn, job)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	code, err := p.docker.client.execExitCode(ctx, execID)
+	if err != nil {
+		return err
+	}
+
+	// the container is only ever used for this program, so an OOM kill in it was the program's
+	oom, err := p.docker.client.oomKilled(context.Background(), c.id)
+	if err == nil && oom {
+		return memoryLimitError(job.Limits)
+	}
+	if code != 0 {
+		return signals.exitError(code)
+	}
+	return nil
+}
+
+// the pool's stats for every language, sorted by name
+func (p *PoolRunner) Stats() []PoolStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	stats := make([]PoolStats, 0, len(p.stats))
+	for name, s := range p.stats {
+		current := *s
+		current.Idle = len(p.idle[name])
+		stats = append(stats, current)
+	}
+	slices.SortFunc(stats, func(a PoolStats, b PoolStats) int {
+		return strings.Compare(a.Language, b.Language)
+	})
+	return stats
+}
+
+// remove leftover containers. Call this before Start, or it will remove the pool's own containers
+func (p *PoolRunner) Reap(ctx context.Context) error {
+	return p.docker.Reap(ctx)
+}
+
+// stop filling the pool and remove every container, idle or running
+func (p *PoolRunner) Close() error {
+	p.mtx.Lock()
+	cancel, done := p.cancel, p.done
+	p.mtx.Unlock()
+	cancel()
+	<-done
+
+	p.mtx.Lock()
+	var idle []*warmContainer
+	for name, containers := range p.idle {
+		idle = append(idle, containers...)
+		delete(p.idle, name)
+	}
+	p.mtx.Unlock()
+
+	for _, c := range idle {
+		p.discard(c, ProcLog)
+	}
+	return p.docker.Close()
+}
+
+// copy the files under src into dst, which must exist
+func copyTree(src string, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir():
+			return os.Mkdir(target, 0o700)
+		case d.Type().IsRegular() == false:
+			// only the server writes source directories, so there shouldn't be anything else
+			return fmt.Errorf("can't copy %s: not a regular file", p)
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -1,27 +1,59 @@
 package procweb
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
-	"path"
+	"slices"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
-var ProcLog *log.Logger = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmsgprefix|log.Llongfile)
+// the server's log. Chatter about every message and pipe is at slog.LevelDebug, and each
+// instance logs through InstanceConfig.Logger instead, with the instance's ID
+var ProcLog = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// whether the log includes what clients send, like their programs and their input. It's
+// students' work and whatever they type, so it's left out unless this is set
+var LogUserContent = false
+
+// an attribute for content a client sent: the content itself if LogUserContent is set,
+// otherwise just how big it is
+func userContent(key string, content string) slog.Attr {
+	if LogUserContent {
+		return slog.String(key, content)
+	}
+	return slog.Int(key+"_bytes", len(content))
+}
 
 // a type representing the json messages sent between the client/code instance websocket
 type ProcMessage struct {
 	Category string `json:"category"`
 	Body     string `json:"body"`
+	// the server numbers the messages it sends from 1, in the order it sends them
+	Seq uint64 `json:"seq,omitempty"`
+	// when the server captured the message, in microseconds since the Unix epoch
+	Time int64 `json:"time,omitempty"`
+	// how Body is encoded, "" for plain text or EncodingBase64 for output that isn't UTF-8
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// when the server started, which capture times are measured from
+var clockStart = time.Now()
+
+// the current time for a message's Time. It follows the monotonic clock, so captured
+// messages never go back in time even if the system clock does
+func captureTime() int64 {
+	return clockStart.UnixMicro() + time.Since(clockStart).Microseconds()
 }
 
 // helper functions
@@ -33,7 +65,7 @@ func shutdownWs(ws *websocket.Conn, mtx *sync.Mutex) {
 	err := ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	mtx.Unlock()
 	if err != nil {
-		ProcLog.Print(err)
+		ProcLog.Debug("failed to close websocket", "err", err)
 		ws.Close()
 	}
 }
@@ -47,38 +79,104 @@ func jsonFromMsg(msg ProcMessage) ([]byte, error) {
 	return result, nil
 }
 
+// forward messages from stdout and stderr to the returned channel in the order they were
+// captured. The returned channel is closed once both are closed
+func mergeOutput(ctx context.Context, stdout chan ProcMessage, stderr chan ProcMessage) chan ProcMessage {
+	out := make(chan ProcMessage, 8)
+	go func() {
+		defer close(out)
+		// the next message from each input. Inputs are set to nil once they close, which
+		// makes them block forever in a select
+		ins := [2]chan ProcMessage{stdout, stderr}
+		var heads [2]*ProcMessage
+		take := func(i int, msg ProcMessage, ok bool) {
+			if ok == false {
+				ins[i] = nil
+				return
+			}
+			heads[i] = &msg
+		}
+
+		for {
+			// pick up anything that's already waiting, so the earliest message goes first
+			for i, in := range ins {
+				if heads[i] != nil || in == nil {
+					continue
+				}
+				select {
+				case msg, ok := <-in:
+					take(i, msg, ok)
+				default:
+				}
+			}
+
+			next := -1
+			for i, head := range heads {
+				if head != nil && (next == -1 || head.Time < heads[next].Time) {
+					next = i
+				}
+			}
+			if next == -1 {
+				if ins[0] == nil && ins[1] == nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok := <-ins[0]:
+					take(0, msg, ok)
+				case msg, ok := <-ins[1]:
+					take(1, msg, ok)
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- *heads[next]:
+				heads[next] = nil
+			}
+		}
+	}()
+	return out
+}
+
 // process i/o
 // =====================================
 
-// write messages to the subprocess stdin, reading from inChan
+// write messages to the subprocess stdin, reading from inChan. log is the run's logger
 func inScanner(ctx context.Context,
 	cancel context.CancelFunc,
 	pipe io.WriteCloser,
 	inChan chan []byte,
+	log *slog.Logger,
 ) {
 	defer pipe.Close()
-	defer ProcLog.Println("closing stdin pipe")
-ScannerLoop:
+	defer log.Debug("closing stdin pipe")
 	for {
 		select {
 		case <-ctx.Done():
-			ProcLog.Println("write to stdin cancelled")
+			log.Debug("write to stdin cancelled")
 			cancel()
 			return
 
 		case msg, ok := <-inChan:
 			if ok == false {
-				ProcLog.Println("inChan closed")
+				log.Debug("stdin ended")
 				return
 			}
-			ProcLog.Println(string(msg))
+			log.Debug("stdin", userContent("input", string(msg)))
 			_, err := pipe.Write(msg)
 			if err != nil {
-				if errors.Is(err, fs.ErrClosed) {
-					ProcLog.Println("stdin: closed")
-					break ScannerLoop
+				// the process may have stopped reading before we ran out of input
+				if errors.Is(err, fs.ErrClosed) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, syscall.EPIPE) {
+					log.Debug("stdin closed by the program")
+					return
 				}
-				ProcLog.Fatal("stdin: ", err)
+				log.Error("failed to write to stdin", "err", err)
+				cancel()
+				return
 			}
 		}
 	}
@@ -87,52 +185,79 @@ ScannerLoop:
 // websocket communication
 // =====================================
 
-// read from a subprocess output pipe, and write them to outChan
+// the size of the reads from a subprocess output pipe
+const outReadSize = 2048
+
+// read from a subprocess output pipe, and write them to outChan. Messages end on a rune
+// boundary, so a UTF-8 character split between two reads is sent whole with the second.
+// log is the run's logger
 func outScanner(ctx context.Context,
 	cancel context.CancelFunc,
 	pipe io.ReadCloser,
 	outChan chan ProcMessage,
 	name string,
+	log *slog.Logger,
 ) {
 	defer pipe.Close()
 	defer close(outChan)
 
+	// the message body is a copy, so the buffer can be reused. It starts with the
+	// incomplete character held back from the last read, if there was one
+	buf := make([]byte, utf8.UTFMax+outReadSize)
+	held := 0
+	send := func(body []byte) bool {
+		select {
+		case <-ctx.Done():
+			log.Debug("output cancelled", "stream", name)
+			return false
+		case outChan <- ProcMessage{Category: name, Body: string(body), Time: captureTime()}:
+			return true
+		}
+	}
 	for {
-		msg := make([]byte, 2048)
-		n, err := pipe.Read(msg)
+		n, err := pipe.Read(buf[held : held+outReadSize])
+		if n > 0 {
+			total := held + n
+			end := completeRunes(buf[:total])
+			if end > 0 && send(buf[:end]) == false {
+				return
+			}
+			held = copy(buf, buf[end:total])
+		}
 		if err != nil {
+			// whatever is held back isn't going to be finished
+			if held > 0 && send(buf[:held]) == false {
+				return
+			}
 			// these two branches are non-error end states, so don't cancel
 			if errors.Is(err, fs.ErrClosed) {
-				ProcLog.Println(name, "pipe closed")
+				log.Debug("output pipe closed", "stream", name)
 				return
 			}
 			if errors.Is(err, io.EOF) {
-				ProcLog.Println(name, "pipe EOF")
+				log.Debug("output pipe ended", "stream", name)
 				return
 			}
 			// something bad happened, shut it all down
-			ProcLog.Println(name, err)
+			log.Error("failed to read output", "stream", name, "err", err)
 			cancel()
 			return
 		}
-
-		select {
-		case <-ctx.Done():
-			ProcLog.Println(name, "cancelled")
-			return
-		case outChan <- ProcMessage{Category: name, Body: string(msg[:n])}:
-			continue
-		}
 	}
 }
 
-// starts a new goroutine that reads from the socket and writes to the returned channel
+// starts a new goroutine that reads from the socket and writes to the returned channel.
+// log is the logger of the instance the socket belongs to, nil for ProcLog
 func ScanProcConnection(
 	ctx context.Context,
 	cancel context.CancelFunc,
 	ws *websocket.Conn,
 	mtx *sync.Mutex,
+	log *slog.Logger,
 ) <-chan ProcMessage {
+	if log == nil {
+		log = ProcLog
+	}
 	// create output channel
 	dest := make(chan ProcMessage)
 	// start a new thread to decode
@@ -141,12 +266,11 @@ func ScanProcConnection(
 		defer close(dest)
 
 		for {
-			var msg ProcMessage
-			err := ws.ReadJSON(&msg)
+			msg, err := readProcMessage(ws)
 
 			// if there is an error, tell everyone to stop
 			if err != nil {
-				ProcLog.Println(err)
+				log.Debug("stopped reading websocket", "err", err)
 				cancel()
 				return
 			}
@@ -154,11 +278,11 @@ func ScanProcConnection(
 			select {
 			// check if anyone else has called cancel()
 			case <-ctx.Done():
-				ProcLog.Println("stdin cancelling")
+				log.Debug("reading websocket cancelled")
 				return
 			case dest <- msg:
 				// do our normal stuff
-				ProcLog.Println(msg)
+				log.Debug("received", "category", msg.Category, userContent("body", msg.Body))
 			}
 		}
 	}()
@@ -167,34 +291,39 @@ func ScanProcConnection(
 }
 
 // Starts a new goroutine that reads from outgoingMsgChan and sends ProcMessages through sock.
-// category is only used for logging, since the outgoing messages already have their own category field
+// category is only used for logging, since the outgoing messages already have their own category field.
+// log is the logger of the instance the socket belongs to, nil for ProcLog
 func SendProcConnection(
 	ctx context.Context,
 	cancel context.CancelFunc,
 	ws *websocket.Conn,
 	mtx *sync.Mutex,
+	log *slog.Logger,
 	outgoingMsgChan chan ProcMessage,
 	category string,
 ) {
+	if log == nil {
+		log = ProcLog
+	}
 	go func() {
 		defer shutdownWs(ws, mtx)
 		for {
 			select {
 			case <-ctx.Done():
-				ProcLog.Print(category, ": cancelled")
+				log.Debug("sending cancelled", "sender", category)
 				return
 			case msg, ok := <-outgoingMsgChan:
 				if ok == false {
-					ProcLog.Println("ougoingMsgChan closed")
+					log.Debug("nothing more to send", "sender", category)
 					return
 				}
 
 				mtx.Lock()
-				err := ws.WriteJSON(msg)
+				err := writeProcMessage(ws, msg)
 				mtx.Unlock()
 
 				if err != nil {
-					ProcLog.Print(err)
+					log.Debug("failed to send", "sender", category, "err", err)
 					cancel()
 					return
 				}
@@ -203,143 +332,373 @@ func SendProcConnection(
 	}()
 }
 
-// running & managing the actual instance
-// =====================================
+// parse the body of a "resize" message, like {"rows": 24, "cols": 80}
+func parseTermSize(body string) (TermSize, error) {
+	var size TermSize
+	err := json.Unmarshal([]byte(body), &size)
+	if err != nil {
+		return size, fmt.Errorf("bad terminal size %q: %w", body, err)
+	}
+	if size.Rows == 0 || size.Cols == 0 {
+		return size, fmt.Errorf("bad terminal size %q: rows and cols must be positive", body)
+	}
+	return size, nil
+}
 
-// run a lua program
-func runLua(ctx context.Context,
-	cancel context.CancelFunc,
-	sourceDir string,
-	stdinChan chan []byte,
-	stdoutChan chan ProcMessage,
-	stderrChan chan ProcMessage,
-	wg *sync.WaitGroup,
-) {
-	defer wg.Done()
+// the signals that the client can send to its program, by the names it uses for them
+var clientSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+}
 
-	// prepare the process
-	proc := exec.CommandContext(ctx, "bin/starter", sourceDir)
+// parse the body of a "signal" message, like SIGINT
+func parseSignal(body string) (syscall.Signal, error) {
+	sig, ok := clientSignals[body]
+	if ok == false {
+		return 0, fmt.Errorf("unsupported signal %q", body)
+	}
+	return sig, nil
+}
 
-	stdin, err := proc.StdinPipe()
-	if err != nil {
-		ProcLog.Print(err)
-		cancel()
-		return
+// the names of signals that programs commonly die from
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// a signal's name, like SIGINT
+func signalName(sig syscall.Signal) string {
+	name, ok := signalNames[sig]
+	if ok == false {
+		return fmt.Sprintf("signal %d", int(sig))
 	}
-	stdout, err := proc.StdoutPipe()
-	if err != nil {
-		ProcLog.Print(err)
-		cancel()
-		return
+	return name
+}
+
+// describe how a program ended for the client's "exit" message. limit is the limit that
+// stopped it, if any, and killed is whether the client had it killed
+func describeExit(err error, killed bool, limit string) string {
+	if limit != "" {
+		return "stopped: " + limit
 	}
-	stderr, err := proc.StderrPipe()
-	if err != nil {
-		ProcLog.Print(err)
-		cancel()
-		return
+	if err == nil {
+		return "exited normally"
+	}
+	if killed {
+		return "killed"
 	}
+	if sig, ok := exitSignal(err); ok {
+		return "terminated by " + signalName(sig)
+	}
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return fmt.Sprintf("exited with status %d", coded.ExitCode())
+	}
+	return "failed: " + err.Error()
+}
 
-	err = proc.Start()
-	if err != nil {
-		ProcLog.Print(err)
-		cancel()
-		return
+// ExitStatus is the body of the "exit" message that ends every run
+type ExitStatus struct {
+	// the program's exit status. A program killed by signal n gets 128+n, like shells report
+	// it, and -1 means the program couldn't be run at all
+	Code int `json:"code"`
+	// the signal that killed the program, like SIGINT
+	Signal string `json:"signal,omitempty"`
+	// how long the program ran, in seconds
+	WallTime float64 `json:"wallTime"`
+	// the CPU time the program used in seconds, and its peak memory in bytes, if the runner measured them
+	CPUTime    float64 `json:"cpuTime,omitempty"`
+	PeakMemory int64   `json:"peakMemory,omitempty"`
+	// the limit that stopped the program, if one did
+	Limit string `json:"limit,omitempty"`
+	// how many bytes of output were dropped after the output was truncated
+	OutputDropped int64 `json:"outputDropped,omitempty"`
+	// how the program ended in words, like "exited with status 1"
+	Description string `json:"description"`
+}
+
+// the exit status of a program that ran for wall, given the error from running it, the
+// limit that stopped it and whether the client had it killed
+func newExitStatus(err error, killed bool, limit string, wall time.Duration, usage Usage) ExitStatus {
+	status := ExitStatus{
+		WallTime:    wall.Seconds(),
+		CPUTime:     usage.CPUTime.Seconds(),
+		PeakMemory:  usage.PeakMemory,
+		Limit:       limit,
+		Description: describeExit(err, killed, limit),
 	}
 
-	// write to stdin pipe
-	go inScanner(ctx, cancel, stdin, stdinChan)
-	// read from stdout pipe
-	go outScanner(ctx, cancel, stdout, stdoutChan, "stdout")
-	// read from stderr pipe
-	go outScanner(ctx, cancel, stderr, stderrChan, "stderr")
+	sig, signalled := exitSignal(err)
+	var coded interface{ ExitCode() int }
+	switch {
+	case err == nil:
+	case signalled:
+		status.Code = 128 + int(sig)
+		status.Signal = signalName(sig)
+	case errors.As(err, &coded):
+		status.Code = coded.ExitCode()
+	case killed || limit != "":
+		// cancelling the run is how we stop programs, and every runner kills them for it
+		status.Code = 128 + int(syscall.SIGKILL)
+		status.Signal = signalName(syscall.SIGKILL)
+	default:
+		status.Code = -1
+	}
+	return status
+}
 
-	err = proc.Wait()
-	if err != nil {
-		ProcLog.Println(err)
+// tell the client that its program couldn't be run, and close the socket
+func abortInstance(ws *websocket.Conn, mtx *sync.Mutex, sent *uint64, err error) {
+	body, jsonErr := json.Marshal(ExitStatus{Code: -1, Description: describeExit(err, false, "")})
+	if jsonErr == nil {
+		writeMessage(ws, mtx, sent, ProcMessage{Category: "exit", Body: string(body)})
 	}
-	ProcLog.Println("proc done")
+	shutdownWs(ws, mtx)
 }
 
-// run a new program with CLI I/O being sent over the network
-func NewInstance(ws *websocket.Conn) {
-	ctx, cancel := context.WithCancel(context.Background())
-	var mtx sync.Mutex
+// running & managing the actual instance
+// =====================================
 
-	var wg sync.WaitGroup
+// how long a program has to exit after the client sends SIGTERM, before it's killed
+const DefaultKillGrace = 3 * time.Second
+
+// the settings for one code instance
+type InstanceConfig struct {
+	// the backend that runs the program
+	Runner Runner
+	// the language the program is written in
+	Language Language
+	// the resources the program may use
+	Limits Limits
+	// run the program on a pseudo-terminal, so that it behaves like it would in a local terminal
+	PTY bool
+	// how long the program has to exit after the client sends SIGTERM. Zero means DefaultKillGrace
+	KillGrace time.Duration
+	// caps how many programs run at once. nil means no cap
+	Admission *Admission
+	// says whether the client may start another program, and if not how long until it may.
+	// Clients coming back to a program they already started aren't asked about. nil means
+	// clients can start as many as they like
+	AllowRun func() (bool, time.Duration)
+	// keeps programs running for clients whose connections drop, so they can come back.
+	// nil means a program is killed as soon as its client leaves
+	Sessions *SessionStore
+	// lets other clients join the program, to watch it or pair on it. nil means programs
+	// can't be shared
+	Hub *Hub
+	// keeps a recording of the program's run. nil means it isn't recorded
+	Recorder *Recorder
+	// counts the run in the server's metrics. nil means it isn't counted
+	Metrics *Metrics
+	// where the instance logs, like the request's logger so that its ID carries through.
+	// The instance's ID is added to it. nil means ProcLog
+	Logger *slog.Logger
+}
 
-	// read the program
-	var prog bytes.Buffer
-	prog.WriteString("io.stdout:setvbuf(\"no\")\nio.stderr:setvbuf(\"no\")\n")
+func (c InstanceConfig) logger() *slog.Logger {
+	if c.Logger == nil {
+		return ProcLog
+	}
+	return c.Logger
+}
 
+// run a new program with CLI I/O being sent over the network
+func NewInstance(ws *websocket.Conn, config InstanceConfig) {
+	var mtx sync.Mutex
+	lang := config.Language
+	id := newInstanceID()
+	log := config.logger().With("instance", id)
+	// messages written to the socket before the sender starts
+	var sent uint64
+	// tell the client what it did wrong, without stopping
+	reject := func(err *ProtocolError) {
+		log.Info("protocol error", "err", err)
+		writeMessage(ws, &mtx, &sent, errorMessage(err))
+	}
+
+	// the client says hello first, then sends its program. Clients from before the handshake
+	// start with the program, and get version 1 without being welcomed.
+	// A program is either "code" messages, which make up the language's usual file, or
+	// "file" messages for any number of files. The client can also say which file the
+	// program starts from, and the size of its terminal
+	workspace := NewWorkspace()
+	var entrypoint string
+	var size TermSize
+	// whether the client understands "queued" messages
+	queueUpdates := false
+	// whether the client understands "truncated" messages. Clients that don't see the
+	// notice as part of stderr instead
+	truncateNotices := false
+	// whether the client can decode output that isn't UTF-8. Clients that can't get it with
+	// the bad bytes replaced by U+FFFD, since that's what JSON encoding does
+	base64Output := false
+	// what the client can come back with if its connection drops
+	token := ""
+	// what other clients can join with
+	watchToken, pairToken := "", ""
+	// what the run's recording is kept under, "" for a new one
+	recordingToken := ""
+	first := true
+ReadLoop:
 	for {
-		var msg ProcMessage
-		err := ws.ReadJSON(&msg)
+		msg, err := readProcMessage(ws)
 		if err != nil {
 			shutdownWs(ws, &mtx)
-			ProcLog.Print("error reading program", err)
+			log.Info("client left before sending its program", "err", err)
 			return
 		}
-		if msg.Category == "EOF" {
-			break
+		switch msg.Category {
+		case "hello":
+			if first == false {
+				reject(protocolErrorf(ErrUnexpectedMessage, "hello has to be the first message"))
+				break
+			}
+			welcome, perr := negotiate(msg.Body, id)
+			if perr != nil {
+				reject(perr)
+				shutdownWs(ws, &mtx)
+				return
+			}
+			base64Output = slices.Contains(welcome.Features, "base64")
+			hello, _ := parseHello(msg.Body)
+			if hello.Resume != "" {
+				resumeInstance(ws, &mtx, config.Sessions, welcome, hello, base64Output, config.logger())
+				return
+			}
+			if hello.Language != "" {
+				lang, err = LookupLanguage(hello.Language)
+				if err != nil {
+					reject(protocolErrorf(ErrBadHello, "%s", err))
+					shutdownWs(ws, &mtx)
+					return
+				}
+				config.Language = lang
+			}
+			queueUpdates = slices.Contains(welcome.Features, "queue")
+			truncateNotices = slices.Contains(welcome.Features, "truncated")
+			if slices.Contains(welcome.Features, "resume") {
+				if config.Sessions == nil {
+					welcome.Features = slices.DeleteFunc(welcome.Features, func(v string) bool { return v == "resume" })
+				} else {
+					token = newToken()
+					welcome.Resume = token
+				}
+			}
+			if slices.Contains(welcome.Features, "viewers") {
+				if config.Hub == nil {
+					welcome.Features = slices.DeleteFunc(welcome.Features, func(v string) bool { return v == "viewers" })
+				} else {
+					watchToken, pairToken = newToken(), newToken()
+					welcome.Watch, welcome.Pair = watchToken, pairToken
+				}
+			}
+			if config.Recorder != nil {
+				recordingToken = newToken()
+				welcome.Recording = recordingToken
+			}
+			body, _ := json.Marshal(welcome)
+			writeMessage(ws, &mtx, &sent, ProcMessage{Category: "welcome", Body: string(body)})
+			log.Info("client said hello", "version", welcome.Version, "features", welcome.Features)
+		case "code":
+			workspace.Append(lang.FileName, msg.Body)
+		case "file":
+			err = workspace.AppendMessage(msg.Body)
+			if err != nil {
+				reject(protocolErrorf(ErrBadMessage, "%s", err))
+			}
+		case "entrypoint":
+			err = validateFilePath(msg.Body)
+			if err != nil {
+				reject(protocolErrorf(ErrBadMessage, "%s", err))
+				break
+			}
+			entrypoint = msg.Body
+		case "EOF":
+			break ReadLoop
+		case "resize":
+			size, err = parseTermSize(msg.Body)
+			if err != nil {
+				reject(protocolErrorf(ErrBadMessage, "%s", err))
+			}
+		case "signal":
+			// nothing is running yet
+		case "stdin":
+			reject(protocolErrorf(ErrUnexpectedMessage, "stdin before the end of the program"))
+		default:
+			reject(protocolErrorf(ErrUnknownCategory, "unknown message category %q", msg.Category))
 		}
-		prog.WriteString(msg.Body)
+		first = false
 	}
 
-	ProcLog.Println("program:", prog.String())
-
-	// write the program to a temporary file
-	instancePath, err := os.MkdirTemp("/tmp", "luasource-")
-	if err != nil {
-		shutdownWs(ws, &mtx)
-		ProcLog.Print("failed to make directory for program file:", err)
-		return
+	if config.AllowRun != nil {
+		ok, retryAfter := config.AllowRun()
+		if ok == false {
+			err := protocolErrorf(ErrRateLimited, "you've run a lot of programs lately, try again in %s", retryAfter.Round(time.Second))
+			reject(err)
+			abortInstance(ws, &mtx, &sent, err)
+			return
+		}
 	}
-	defer os.RemoveAll(instancePath)
-	err = os.WriteFile(path.Join(instancePath, "main.lua"), prog.Bytes(), os.FileMode(0o600))
+
+	// the program runs for as long as it takes, or until its client leaves for good
+	run, err := StartRun(context.Background(), config, Program{ID: id, Files: workspace, Entrypoint: entrypoint, Size: size, Recording: recordingToken})
 	if err != nil {
-		shutdownWs(ws, &mtx)
-		ProcLog.Print("failed to write program to file:", err)
+		if perr, ok := err.(*ProtocolError); ok {
+			reject(perr)
+		} else if errors.Is(err, ErrQueueFull) {
+			// the client can try again in a while
+			reject(protocolErrorf(ErrBusy, "%s", err))
+		} else {
+			log.Error("failed to start program", "err", err)
+		}
+		abortInstance(ws, &mtx, &sent, err)
 		return
 	}
 
-	// these hold messages I/O for the lua process
-	stdinChan := make(chan []byte, 8)
-	stdoutChan := make(chan ProcMessage, 8)
-	stderrChan := make(chan ProcMessage, 8)
-
-	// scan our process I/O
-	incomingMsgChan := ScanProcConnection(ctx, cancel, ws, &mtx)
-	SendProcConnection(ctx, cancel, ws, &mtx, stdoutChan, "stdout")
-	SendProcConnection(ctx, cancel, ws, &mtx, stderrChan, "stderr")
-
-	// consume the incoming messages and pass new messages to the right places
-	// for example, forward the body of stdin messages to stdinChan
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-incomingMsgChan:
-				switch msg.Category {
-				case "stdin":
-					stdinChan <- []byte(msg.Body)
-				case "EOF":
-					if msg.Body == "stdin" {
-						// end stdin, no more input
-						close(stdinChan)
-					}
-					return
-				default:
-					ProcLog.Printf("unsupported message category: %s", msg.Category)
-				}
-			}
-		}
-	}()
+	session := newSession(id, run, sent)
+	session.queueUpdates = queueUpdates
+	session.truncateNotices = truncateNotices
+	if token != "" {
+		session.resumeWith(config.Sessions, token)
+	}
+	if watchToken != "" {
+		session.shareWith(config.Hub, watchToken, pairToken)
+	}
+	session.serve(ws, &mtx, base64Output, sent, "")
+}
 
-	// run the program
-	wg.Add(1)
-	go runLua(ctx, cancel, instancePath, stdinChan, stdoutChan, stderrChan, &wg)
+// attach a client that's coming back to its instance after its connection dropped
+func resumeInstance(ws *websocket.Conn, mtx *sync.Mutex, store *SessionStore, welcome Welcome, hello Hello, base64Output bool, log *slog.Logger) {
+	var session *Session
+	if store != nil {
+		session = store.get(hello.Resume)
+	}
+	if session == nil {
+		err := protocolErrorf(ErrResumeFailed, "the program isn't running any more")
+		log.Info("protocol error", "err", err)
+		writeMessage(ws, mtx, nil, errorMessage(err))
+		shutdownWs(ws, mtx)
+		return
+	}
 
-	wg.Wait()
-	ProcLog.Println("program done")
+	// the welcome isn't part of the instance's numbered messages, which carry on from
+	// where the client got up to
+	welcome.Instance = session.id
+	welcome.Resume = hello.Resume
+	welcome.Recording = session.run.Recording()
+	body, _ := json.Marshal(welcome)
+	writeMessage(ws, mtx, nil, ProcMessage{Category: "welcome", Body: string(body)})
+	session.log.Info("client is back", "last_seq", hello.LastSeq)
+	session.serve(ws, mtx, base64Output, hello.LastSeq, "")
 }
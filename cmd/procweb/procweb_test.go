@@ -1,22 +1,28 @@
 package procweb
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"reflect"
 	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -29,7 +35,7 @@ var httpServerState struct {
 	socks   chan *websocket.Conn
 }
 
-var upgrader = websocket.Upgrader{}
+var upgrader = websocket.Upgrader{Subprotocols: []string{BinarySubprotocol}}
 
 var serverStarted bool = false
 
@@ -65,9 +71,15 @@ func startServer() {
 		Handler: srv,
 	}
 
+	// listen before returning, so that callers can dial right away
+	listener, err := net.Listen("tcp", httpServerState.srv.Addr)
+	if err != nil {
+		panic(err)
+	}
+	httpServerState.started = true
+
 	go func() {
-		httpServerState.started = true
-		if err := httpServerState.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := httpServerState.srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 			httpServerState.started = false
 		}
 	}()
@@ -77,12 +89,21 @@ func startServer() {
 // create two sockets that are connected to each other
 // similar to io.Pipe()
 func createSockets() (*websocket.Conn, *websocket.Conn) {
+	return dialSockets(websocket.DefaultDialer)
+}
+
+// create two connected sockets that send binary frames
+func createFramedSockets() (*websocket.Conn, *websocket.Conn) {
+	return dialSockets(&websocket.Dialer{Subprotocols: []string{BinarySubprotocol}})
+}
+
+func dialSockets(dialer *websocket.Dialer) (*websocket.Conn, *websocket.Conn) {
 
 	// start the server, if necessary
 	startServer()
 
 	//dialer
-	dialSock, _, err := websocket.DefaultDialer.Dial("ws://localhost:4041", nil)
+	dialSock, _, err := dialer.Dial("ws://localhost:4041", nil)
 	if err != nil {
 		panic(err)
 	}
@@ -135,6 +156,62 @@ func TestJsonFromMsg(t *testing.T) {
 	}
 }
 
+// Language tests
+// ===========================
+
+// a command joined with shellJoin should give the shell back the same arguments
+func shellJoinIdentity(in []string) bool {
+	for _, v := range in {
+		// arguments can't contain NUL bytes
+		if strings.ContainsRune(v, 0) {
+			return true
+		}
+	}
+
+	script := "printf '%s\\0' " + shellJoin(in)
+	if len(in) == 0 {
+		script = "true"
+	}
+	out, err := exec.Command("/bin/sh", "-c", script).Output()
+	if err != nil {
+		return false
+	}
+
+	var result []string
+	for _, v := range strings.SplitAfter(string(out), "\x00") {
+		if v != "" {
+			result = append(result, strings.TrimSuffix(v, "\x00"))
+		}
+	}
+	return slices.Equal(in, result)
+}
+
+func TestShellJoin(t *testing.T) {
+	c := quick.Config{MaxCount: 1_000}
+
+	if err := quick.Check(shellJoinIdentity, &c); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLookupLanguage(t *testing.T) {
+	lang, err := LookupLanguage("")
+	if err != nil || lang.Name != DefaultLanguage {
+		t.Errorf("empty language should be %s, got %v (%v)", DefaultLanguage, lang.Name, err)
+	}
+
+	_, err = LookupLanguage("cobol")
+	if err == nil {
+		t.Error("expected an error for an unsupported language")
+	}
+
+	for name, lang := range Languages {
+		if lang.Name != name || lang.FileName == "" || len(lang.Run) == 0 || lang.Image == "" {
+			t.Errorf("incomplete language definition: %s", name)
+		}
+	}
+}
+
 // inScanner tests
 // ===========================
 
@@ -146,7 +223,7 @@ func inScannerIdentity(in [][]byte) bool {
 	reader, writer := io.Pipe()
 	inChan := make(chan []byte, 8)
 
-	go inScanner(ctx, cancel, writer, inChan)
+	go inScanner(ctx, cancel, writer, inChan, ProcLog)
 
 	// push data into the scanner's channel
 	go func() {
@@ -197,7 +274,7 @@ func outScannerIdentity(in struct {
 	reader, writer := io.Pipe()
 	outChan := make(chan ProcMessage, 8)
 
-	go outScanner(ctx, cancel, reader, outChan, in.Name)
+	go outScanner(ctx, cancel, reader, outChan, in.Name, ProcLog)
 
 	// push data into the scanner's pipe
 	go func() {
@@ -239,7 +316,7 @@ func scanConnectionIdentity(in []ProcMessage) bool {
 
 	// start the scanner
 	ctx, cancel := context.WithCancel(context.Background())
-	result_msg_chan := ScanProcConnection(ctx, cancel, readSock, &mtx)
+	result_msg_chan := ScanProcConnection(ctx, cancel, readSock, &mtx, ProcLog)
 
 	// send stuff to the scanner
 	go func() {
@@ -286,7 +363,7 @@ func sendConnectionIdentity(in []ProcMessage) bool {
 	outgoingMsgChan := make(chan ProcMessage, 8)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	SendProcConnection(ctx, cancel, writeSock, &mtx, outgoingMsgChan, "") // the last arg is just for logging
+	SendProcConnection(ctx, cancel, writeSock, &mtx, ProcLog, outgoingMsgChan, "") // the last arg is just for logging
 
 	// put stuff into the sender channel
 	go func() {
@@ -328,6 +405,30 @@ func TestSendProcConnection(t *testing.T) {
 	}
 }
 
+// mergeOutput tests
+// ===========================
+
+func TestMergeOutput(t *testing.T) {
+	stdout := make(chan ProcMessage, 8)
+	stderr := make(chan ProcMessage, 8)
+	for _, v := range []int64{1, 3, 4, 7} {
+		stdout <- ProcMessage{Category: "stdout", Body: fmt.Sprint(v), Time: v}
+	}
+	for _, v := range []int64{2, 5, 6} {
+		stderr <- ProcMessage{Category: "stderr", Body: fmt.Sprint(v), Time: v}
+	}
+	close(stdout)
+	close(stderr)
+
+	var order []string
+	for msg := range mergeOutput(context.Background(), stdout, stderr) {
+		order = append(order, msg.Body)
+	}
+	if want := []string{"1", "2", "3", "4", "5", "6", "7"}; slices.Equal(order, want) == false {
+		t.Errorf("messages weren't merged in capture order: want %q, got %q", want, order)
+	}
+}
+
 // NewInstance tests
 // we want to make properties for each test program
 // probably one for valid inputs and one for invalid inputs
@@ -348,7 +449,7 @@ func msgOfCategory(r *rand.Rand, bodyLenMin int, bodyLenMax int, category string
 		bodyBuilder.WriteRune(thisRune)
 	}
 
-	return ProcMessage{category, bodyBuilder.String()}
+	return ProcMessage{Category: category, Body: bodyBuilder.String()}
 }
 
 func msgCategorySlice(r *rand.Rand, lenMin int, lenMax int, category string) []ProcMessage {
@@ -368,7 +469,13 @@ func msgCategorySlice(r *rand.Rand, lenMin int, lenMax int, category string) []P
 
 // make sure that hello.lua produces the correct output
 // all is does is print "hi"
-func testHelloLua(in []ProcMessage) bool {
+func testHelloLua(runner Runner) func([]ProcMessage) bool {
+	return func(in []ProcMessage) bool {
+		return helloLuaHolds(runner, in)
+	}
+}
+
+func helloLuaHolds(runner Runner, in []ProcMessage) bool {
 	var wg sync.WaitGroup
 
 	f, err := os.Open("test_lua/hello.lua")
@@ -377,7 +484,7 @@ func testHelloLua(in []ProcMessage) bool {
 	}
 
 	ourSock, instanceSock := createSockets()
-	go NewInstance(instanceSock)
+	go NewInstance(instanceSock, InstanceConfig{Runner: runner, Language: Languages["luajit"], Limits: DefaultLimits})
 
 	// write in to ourSock
 	// this shouldn't do anything in this case because hello.lua doesn't read any input
@@ -449,7 +556,13 @@ func testHelloLua(in []ProcMessage) bool {
 	return true
 }
 
-func testEchoLua(in []ProcMessage) bool {
+func testEchoLua(runner Runner) func([]ProcMessage) bool {
+	return func(in []ProcMessage) bool {
+		return echoLuaHolds(runner, in)
+	}
+}
+
+func echoLuaHolds(runner Runner, in []ProcMessage) bool {
 	var wg sync.WaitGroup
 
 	// read the program from a file
@@ -460,7 +573,7 @@ func testEchoLua(in []ProcMessage) bool {
 
 	// start the instance
 	ourSock, instanceSock := createSockets()
-	go NewInstance(instanceSock)
+	go NewInstance(instanceSock, InstanceConfig{Runner: runner, Language: Languages["luajit"], Limits: DefaultLimits})
 
 	// write to in sock
 	wg.Add(1)
@@ -505,7 +618,7 @@ func testEchoLua(in []ProcMessage) bool {
 				break
 			}
 		}
-		msg := ProcMessage{"EOF", "stdin"}
+		msg := ProcMessage{Category: "EOF", Body: "stdin"}
 		ourSock.WriteJSON(msg)
 	}()
 
@@ -559,11 +672,421 @@ func TestNewInstance(t *testing.T) {
 		},
 	}
 
-	if err := quick.Check(testHelloLua, &c); err != nil {
+	// the real programs need docker and the lua image, which CI doesn't have. The fake
+	// programs below cover the same ground
+	runner := NewDockerRunner("")
+	image := Languages["luajit"].Image
+	err := runner.client.do(context.Background(), "GET", "/images/"+image+"/json", nil, nil, nil)
+	if err != nil {
+		t.Skipf("docker or the %s image isn't available: %s", image, err)
+	}
+
+	if err := quick.Check(testHelloLua(runner), &c); err != nil {
+		t.Error(err)
+	}
+
+	if err := quick.Check(testEchoLua(runner), &c); err != nil {
+		t.Error(err)
+	}
+}
+
+// fake versions of the programs in test_lua, for running NewInstance without docker
+// -----------------
+
+func fakeHelloLua(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	_, err := io.WriteString(stdout, "hi\n")
+	return err
+}
+
+func fakeEchoLua(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		_, err := fmt.Fprintln(stdout, scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func TestNewInstanceFake(t *testing.T) {
+	c := quick.Config{
+		MaxCount: 100,
+		Values: func(values []reflect.Value, r *rand.Rand) {
+			values[0] = reflect.ValueOf(msgCategorySlice(r, 5, 30, "stdin"))
+		},
+	}
+
+	if err := quick.Check(testHelloLua(FakeRunner{Program: fakeHelloLua}), &c); err != nil {
 		t.Error(err)
 	}
 
-	if err := quick.Check(testEchoLua, &c); err != nil {
+	if err := quick.Check(testEchoLua(FakeRunner{Program: fakeEchoLua}), &c); err != nil {
 		t.Error(err)
 	}
 }
+
+// a writer that's safe to log to from every goroutine of a run
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+// what the runner logs about a program goes to the instance's logger, with its ID
+func TestRunnerLogs(t *testing.T) {
+	var logs lockedBuffer
+	log := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"], Logger: log}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1}`},
+		{Category: "EOF", Body: "code"},
+		{Category: "stdin", Body: "one\n"},
+		{Category: "EOF", Body: "stdin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var welcome Welcome
+	json.Unmarshal([]byte(msgs[0].Body), &welcome)
+	exitStatus(t, msgs)
+
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `msg="stdin ended"`) {
+			if strings.Contains(line, "instance="+welcome.Instance) == false {
+				t.Errorf("runner logged without the instance: %s", line)
+			}
+			return
+		}
+	}
+	t.Errorf("the runner didn't log to the instance's logger: %s", logs.String())
+}
+
+// a fake program that alternates between stdout and stderr
+func fakeInterleaved(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	for i := range 5 {
+		fmt.Fprintf(stdout, "out %d\n", i)
+		fmt.Fprintf(stderr, "err %d\n", i)
+	}
+	return nil
+}
+
+func TestMessageOrder(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeInterleaved}, Language: Languages["luajit"]}
+	msgs, err := runInstance(config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the two pipes race each other, so only the capture times say which output came first
+	for i, msg := range msgs {
+		if msg.Seq != uint64(i+1) {
+			t.Errorf("message %d has seq %d", i, msg.Seq)
+		}
+		if msg.Time == 0 || (i > 0 && msg.Time < msgs[i-1].Time) {
+			t.Errorf("message %d was captured at %d, before the message sent ahead of it", i, msg.Time)
+		}
+	}
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != "out 0\nout 1\nout 2\nout 3\nout 4\n" {
+		t.Errorf("bad stdout %q", stdout.Body)
+	}
+	if stderr := combineCategory(msgs, "stderr"); stderr.Body != "err 0\nerr 1\nerr 2\nerr 3\nerr 4\n" {
+		t.Errorf("bad stderr %q", stderr.Body)
+	}
+}
+
+// limit tests
+// -----------------
+
+// run an instance with config, send it code and the messages in input, and return everything it sends back
+func runInstance(config InstanceConfig, code string, input []ProcMessage) ([]ProcMessage, error) {
+	msgs := append([]ProcMessage{{Category: "code", Body: code}, {Category: "EOF", Body: "code"}}, input...)
+	return runInstanceMessages(config, msgs)
+}
+
+// run an instance, sending it msgs and returning everything it sends back
+func runInstanceMessages(config InstanceConfig, msgs []ProcMessage) ([]ProcMessage, error) {
+	ourSock, instanceSock := createSockets()
+	return runInstanceOver(ourSock, instanceSock, config, msgs)
+}
+
+// run an instance on instanceSock, sending it msgs over ourSock in whichever format the
+// sockets use
+func runInstanceOver(ourSock *websocket.Conn, instanceSock *websocket.Conn, config InstanceConfig, msgs []ProcMessage) ([]ProcMessage, error) {
+	go NewInstance(instanceSock, config)
+
+	go func() {
+		for _, v := range msgs {
+			err := writeProcMessage(ourSock, v)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var outMsgs []ProcMessage
+	for {
+		msg, err := readProcMessage(ourSock)
+		if err != nil {
+			if websocket.IsCloseError(err, 1000) {
+				return outMsgs, nil
+			}
+			return outMsgs, err
+		}
+		outMsgs = append(outMsgs, msg)
+	}
+}
+
+// the exit status that an instance ended with, which should be its last message
+func exitStatus(t *testing.T, msgs []ProcMessage) ExitStatus {
+	t.Helper()
+	if len(msgs) == 0 || msgs[len(msgs)-1].Category != "exit" {
+		t.Fatalf("expected the last message to be the exit status, got %v", msgs)
+	}
+	var status ExitStatus
+	err := json.Unmarshal([]byte(msgs[len(msgs)-1].Body), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// a fake program that never finishes on its own
+func fakeForever(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// a fake program that prints forever
+func fakeSpam(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	for {
+		_, err := io.WriteString(stdout, "spam spam spam\n")
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestWallClockLimit(t *testing.T) {
+	config := InstanceConfig{
+		Runner:   FakeRunner{Program: fakeForever},
+		Language: Languages["luajit"],
+		Limits:   Limits{WallClock: 100 * time.Millisecond},
+	}
+	msgs, err := runInstance(config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := combineCategory(msgs, "limit")
+	if limit.Body != "time limit exceeded (100ms)" {
+		t.Errorf("expected a time limit message, got %v", msgs)
+	}
+	exit := exitStatus(t, msgs)
+	if exit.Limit != "time limit exceeded (100ms)" || exit.Signal != "SIGKILL" || exit.Code != 137 {
+		t.Errorf("expected an exit message after the limit, got %+v", exit)
+	}
+	if exit.WallTime < 0.1 {
+		t.Errorf("the program ran for longer than %gs", exit.WallTime)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	config := InstanceConfig{
+		Runner:   FakeRunner{Program: fakeSpam},
+		Language: Languages["luajit"],
+		Limits:   Limits{Output: 4 << 10},
+	}
+	msgs, err := runInstance(config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(combineCategory(msgs, "stdout").Body) != 4<<10 {
+		t.Errorf("expected exactly 4 KiB of output, got %d bytes", len(combineCategory(msgs, "stdout").Body))
+	}
+	if limit := combineCategory(msgs, "limit"); limit.Body != "output limit exceeded (4 KiB)" {
+		t.Errorf("expected an output limit message, got %q", limit.Body)
+	}
+}
+
+// a runner that reports the terminal sizes its job gets, stopping after the first resize
+type sizeRunner struct{}
+
+func (sizeRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	defer close(job.Stdout)
+	defer close(job.Stderr)
+	report := func(size TermSize) {
+		job.Stdout <- ProcMessage{Category: "stdout", Body: fmt.Sprintf("%dx%d\n", size.Rows, size.Cols)}
+	}
+
+	report(job.termSize())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case size := <-job.Resize:
+		report(size)
+	}
+	return nil
+}
+
+func TestResize(t *testing.T) {
+	config := InstanceConfig{Runner: sizeRunner{}, Language: Languages["python"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "resize", Body: `{"rows": 30, "cols": 100}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+		{Category: "EOF", Body: "stdin"},
+		{Category: "resize", Body: `{"rows": 0, "cols": 10}`},
+		{Category: "resize", Body: `{"rows": 40, "cols": 120}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != "30x100\n40x120\n" {
+		t.Errorf("expected the initial size and then the resize, got %q", stdout.Body)
+	}
+}
+
+// signal tests
+// -----------------
+
+func TestSignal(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeForever}, Language: Languages["luajit"]}
+	msgs, err := runInstance(config, "", []ProcMessage{
+		{Category: "signal", Body: "SIGSTOP"},
+		{Category: "signal", Body: "SIGINT"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit := exitStatus(t, msgs); exit.Description != "terminated by SIGINT" || exit.Code != 130 {
+		t.Errorf("expected the program to be interrupted, got %+v", exit)
+	}
+}
+
+// a runner whose program ignores every signal
+type stubbornRunner struct{}
+
+func (stubbornRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	defer close(job.Stdout)
+	defer close(job.Stderr)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-job.Signals:
+		}
+	}
+}
+
+func TestKillGrace(t *testing.T) {
+	config := InstanceConfig{Runner: stubbornRunner{}, Language: Languages["luajit"], KillGrace: 100 * time.Millisecond}
+	start := time.Now()
+	msgs, err := runInstance(config, "", []ProcMessage{{Category: "signal", Body: "SIGTERM"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit := exitStatus(t, msgs); exit.Description != "killed" || exit.Signal != "SIGKILL" {
+		t.Errorf("expected the program to be killed, got %+v", exit)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the program was killed before its grace period was up, after %s", elapsed)
+	}
+
+	msgs, err = runInstance(config, "", []ProcMessage{{Category: "signal", Body: "SIGKILL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit := exitStatus(t, msgs); exit.Description != "killed" || exit.Signal != "SIGKILL" {
+		t.Errorf("expected the program to be killed, got %+v", exit)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"]}
+	msgs, err := runInstance(config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit := exitStatus(t, msgs)
+	if exit.Code != 0 || exit.Signal != "" || exit.Limit != "" || exit.Description != "exited normally" {
+		t.Errorf("bad exit status for a normal exit: %+v", exit)
+	}
+
+	status := newExitStatus(&ExitError{Code: 1}, false, "", time.Second, Usage{CPUTime: time.Second / 2, PeakMemory: 1 << 20})
+	want := ExitStatus{Code: 1, WallTime: 1, CPUTime: 0.5, PeakMemory: 1 << 20, Description: "exited with status 1"}
+	if status != want {
+		t.Errorf("want %+v, got %+v", want, status)
+	}
+	if status := newExitStatus(errors.New("no such image"), false, "", 0, Usage{}); status.Code != -1 {
+		t.Errorf("a program that never ran should have code -1, got %+v", status)
+	}
+}
+
+func TestDescribeExit(t *testing.T) {
+	cases := []struct {
+		err    error
+		killed bool
+		limit  string
+		want   string
+	}{
+		{nil, false, "", "exited normally"},
+		{nil, true, "", "exited normally"},
+		{&ExitError{Code: 3}, false, "", "exited with status 3"},
+		{&SignalError{Signal: syscall.SIGINT}, false, "", "terminated by SIGINT"},
+		// a program can exit with 128+signal itself
+		{&ExitError{Code: 137}, false, "", "exited with status 137"},
+		{&LimitError{Kind: LimitKindMemory, Reason: "memory limit exceeded (1 MiB)"}, false, "memory limit exceeded (1 MiB)", "stopped: memory limit exceeded (1 MiB)"},
+		{context.Canceled, true, "", "killed"},
+		{errors.New("no such image"), false, "", "failed: no such image"},
+	}
+	for _, c := range cases {
+		if got := describeExit(c.err, c.killed, c.limit); got != c.want {
+			t.Errorf("describeExit(%v, %v, %q): want %q, got %q", c.err, c.killed, c.limit, c.want, got)
+		}
+	}
+}
+
+func TestLimitPolicy(t *testing.T) {
+	policy := LimitPolicy{
+		Default: Limits{CPUTime: time.Second, WallClock: time.Minute, Memory: 64 << 20},
+		Max:     Limits{CPUTime: 5 * time.Second, WallClock: 10 * time.Minute, Memory: 128 << 20},
+	}
+
+	limits, err := policy.Resolve(url.Values{"wallClock": {"2s"}, "memory": {"1073741824"}, "output": {"100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Limits{CPUTime: time.Second, WallClock: 2 * time.Second, Memory: 128 << 20, Output: 100}
+	if limits != want {
+		t.Errorf("want %+v, got %+v", want, limits)
+	}
+
+	_, err = policy.Resolve(url.Values{"cpuTime": {"-1s"}})
+	if err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+
+	if err := policy.Check(); err != nil {
+		t.Error(err)
+	}
+	policy.Default.WallClock = time.Hour
+	if policy.Check() == nil {
+		t.Error("expected an error for a default over its maximum")
+	}
+	// an unlimited default is over any maximum but an unlimited one
+	policy.Default = Limits{}
+	if policy.Check() == nil {
+		t.Error("expected an error for an unlimited default")
+	}
+}
@@ -0,0 +1,170 @@
+package procweb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// the /echo protocol
+// =====================================
+
+// the newest version of the protocol that the server speaks. Clients say which version they
+// speak in their "hello", and the connection uses the older of the two
+const ProtocolVersion = 1
+
+// the optional parts of the protocol that this server supports
+var ProtocolFeatures = []string{"pty", "resize", "signal", "exit", "seq", "files", "queue", "truncated", "base64", "resume", "viewers"}
+
+// the body of the "hello" message, which clients send before anything else
+type Hello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	// the language the program is written in, like "python". "" leaves it to the socket's
+	// ?language= query parameter, which is how clients from before the handshake pick it,
+	// or DefaultLanguage without one
+	Language string `json:"language,omitempty"`
+	// set by a client coming back to its instance after its connection dropped, to the
+	// token it was welcomed with
+	Resume string `json:"resume,omitempty"`
+	// the seq of the last message the client got before its connection dropped
+	LastSeq uint64 `json:"lastSeq,omitempty"`
+	// set by a client joining someone else's instance, to one of the tokens that instance
+	// was welcomed with
+	Join string `json:"join,omitempty"`
+}
+
+// the body of the "welcome" message, the server's reply to a "hello"
+type Welcome struct {
+	// the protocol version the connection uses
+	Version int `json:"version"`
+	// the features that both the client and the server support
+	Features []string `json:"features"`
+	// identifies the instance, like in the server's logs
+	Instance string `json:"instance"`
+	// what the client says in its hello to come back to the instance if its connection
+	// drops, when both sides support "resume"
+	Resume string `json:"resume,omitempty"`
+	// what other clients say in their hello to join the instance, to watch it or to pair
+	// on it, when both sides support "viewers"
+	Watch string `json:"watch,omitempty"`
+	Pair  string `json:"pair,omitempty"`
+	// ViewerWatch or ViewerPair, for clients that joined someone else's instance
+	Mode string `json:"mode,omitempty"`
+	// what the client can replay the run with once it's over, when the server keeps
+	// recordings. Only the client that started the instance is told it
+	Recording string `json:"recording,omitempty"`
+}
+
+// a ProtocolError is sent to the client as the body of an "error" message when it breaks
+// the protocol. Code is meant for programs, Message for people
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// the codes of protocol errors
+const (
+	ErrBadHello           = "bad_hello"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownCategory    = "unknown_category"
+	ErrBadMessage         = "bad_message"
+	ErrUnexpectedMessage  = "unexpected_message"
+	// not a protocol error as such, the client has run too many programs lately
+	ErrRateLimited = "rate_limited"
+	// not a protocol error either, too many programs are already waiting to run
+	ErrBusy = "busy"
+	// the instance a client tried to come back to is gone
+	ErrResumeFailed = "resume_failed"
+	// a client that came back missed more output than the instance kept. Not fatal
+	ErrReplayGap = "replay_gap"
+	// the instance a client tried to join is gone, or was never shared
+	ErrJoinFailed = "join_failed"
+	// a viewer that can only watch tried to send input or signals
+	ErrReadOnly = "read_only"
+	// a viewer fell too far behind the instance's output, and was dropped
+	ErrTooSlow = "too_slow"
+	// there's no finished recording to replay with the token the client asked for
+	ErrNoRecording = "no_recording"
+)
+
+func protocolErrorf(code string, format string, a ...any) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// the "error" message for a protocol error
+func errorMessage(err *ProtocolError) ProcMessage {
+	body, _ := json.Marshal(err)
+	return ProcMessage{Category: "error", Body: string(body)}
+}
+
+// a new random instance ID
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// a new random token for getting into an instance, to resume it or join it. Anyone with
+// one can get in, so it's long enough not to be guessed
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parse the body of a client's "hello"
+func parseHello(body string) (Hello, *ProtocolError) {
+	var hello Hello
+	err := json.Unmarshal([]byte(body), &hello)
+	if err != nil {
+		return hello, protocolErrorf(ErrBadHello, "bad hello %q: %s", body, err)
+	}
+	return hello, nil
+}
+
+// answer the body of a client's "hello" for the instance with the given ID
+func negotiate(body string, instance string) (Welcome, *ProtocolError) {
+	hello, err := parseHello(body)
+	if err != nil {
+		return Welcome{}, err
+	}
+	if hello.Version < 1 {
+		return Welcome{}, protocolErrorf(ErrUnsupportedVersion, "unsupported protocol version %d, the server speaks 1 to %d", hello.Version, ProtocolVersion)
+	}
+
+	welcome := Welcome{
+		Version:  min(hello.Version, ProtocolVersion),
+		Features: []string{},
+		Instance: instance,
+	}
+	for _, v := range ProtocolFeatures {
+		if slices.Contains(hello.Features, v) {
+			welcome.Features = append(welcome.Features, v)
+		}
+	}
+	return welcome, nil
+}
+
+// write a message straight to the socket, for before the instance's sender has started.
+// sent counts the messages sent so far, so that the sender can carry on numbering them.
+// Messages written with a nil sent aren't numbered
+func writeMessage(ws *websocket.Conn, mtx *sync.Mutex, sent *uint64, msg ProcMessage) error {
+	if sent != nil {
+		*sent++
+		msg.Seq = *sent
+	}
+	msg.Time = captureTime()
+	mtx.Lock()
+	defer mtx.Unlock()
+	return writeProcMessage(ws, msg)
+}
@@ -0,0 +1,166 @@
+package procweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+// the protocol errors an instance sent, by code
+func protocolErrors(t *testing.T, msgs []ProcMessage) []string {
+	t.Helper()
+	var codes []string
+	for _, msg := range msgs {
+		if msg.Category != "error" {
+			continue
+		}
+		var err ProtocolError
+		if json.Unmarshal([]byte(msg.Body), &err) != nil || err.Message == "" {
+			t.Errorf("bad error message %q", msg.Body)
+		}
+		codes = append(codes, err.Code)
+	}
+	return codes
+}
+
+func TestNegotiate(t *testing.T) {
+	welcome, err := negotiate(`{"version": 3, "features": ["signal", "telepathy", "pty"]}`, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Welcome{Version: ProtocolVersion, Features: []string{"pty", "signal"}, Instance: "abc"}
+	if welcome.Version != want.Version || slices.Equal(welcome.Features, want.Features) == false || welcome.Instance != want.Instance {
+		t.Errorf("want %+v, got %+v", want, welcome)
+	}
+
+	for body, code := range map[string]string{
+		`{"version": 0}`: ErrUnsupportedVersion,
+		`hi`:             ErrBadHello,
+	} {
+		_, err := negotiate(body, "abc")
+		if err == nil || err.Code != code {
+			t.Errorf("expected %s for %q, got %v", code, body, err)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "features": ["exit", "seq"]}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) == 0 || msgs[0].Category != "welcome" || msgs[0].Seq != 1 {
+		t.Fatalf("expected a welcome first, got %v", msgs)
+	}
+	var welcome Welcome
+	err = json.Unmarshal([]byte(msgs[0].Body), &welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Version != 1 || slices.Equal(welcome.Features, []string{"exit", "seq"}) == false || len(welcome.Instance) != 16 {
+		t.Errorf("bad welcome %+v", welcome)
+	}
+	// the sender carries on numbering after the welcome
+	if msgs[1].Seq != 2 {
+		t.Errorf("expected seq 2 after the welcome, got %d", msgs[1].Seq)
+	}
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != "hi\n" {
+		t.Errorf("bad stdout %q", stdout.Body)
+	}
+}
+
+// a fake program that prints the names of its source files
+func fakeListFiles(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		fmt.Fprintln(stdout, v.Name())
+	}
+	return nil
+}
+
+// the hello picks the language, over the one the socket was opened with
+func TestHandshakeLanguage(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeListFiles}, Language: Languages["luajit"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "language": "python"}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout := combineCategory(msgs, "stdout").Body; stdout != "main.py\n" {
+		t.Errorf("expected the program to be written as python, got %q", stdout)
+	}
+
+	msgs, err = runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "language": "cobol"}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, []string{ErrBadHello}) == false || len(msgs) != 1 {
+		t.Errorf("expected an unknown language to be turned away, got %v", msgs)
+	}
+}
+
+func TestHandshakeUnsupportedVersion(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 0}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, []string{ErrUnsupportedVersion}) == false || len(msgs) != 1 {
+		t.Errorf("expected the instance to give up after an error, got %v", msgs)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "cod", Body: "print('hi')"},
+		{Category: "hello", Body: `{"version": 1}`},
+		{Category: "code", Body: "print('hi')"},
+		{Category: "EOF", Body: "code"},
+		{Category: "stdin", Body: "one\n"},
+		{Category: "signal", Body: "SIGHUP"},
+		{Category: "resize", Body: "big"},
+		{Category: "code", Body: "print('too late')"},
+		{Category: "stdout", Body: "two\n"},
+		{Category: "EOF", Body: "stdin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{ErrUnknownCategory, ErrUnexpectedMessage, ErrBadMessage, ErrBadMessage, ErrUnexpectedMessage, ErrUnknownCategory}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, want) == false {
+		t.Errorf("want errors %q, got %q", want, codes)
+	}
+	// none of it gets in the way of the program
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != "one\n" {
+		t.Errorf("bad stdout %q", stdout.Body)
+	}
+	if exit := exitStatus(t, msgs); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+}
@@ -0,0 +1,148 @@
+package procweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// pseudo-terminals
+// =====================================
+
+// the server's end of a pseudo-terminal. Once the program has closed its end, the kernel
+// reports reads and writes as EIO, which for us just means the program is done with it
+type ptyMaster struct {
+	*os.File
+}
+
+func (p ptyMaster) Read(b []byte) (int, error) {
+	n, err := p.File.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (p ptyMaster) Write(b []byte) (int, error) {
+	n, err := p.File.Write(b)
+	if errors.Is(err, syscall.EIO) {
+		return n, io.ErrClosedPipe
+	}
+	return n, err
+}
+
+// make an ioctl on f without taking it out of non-blocking mode, which f.Fd() would do.
+// Blocking files can't be closed under a reader, and we rely on that to stop instances
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// struct winsize from <sys/ioctl.h>
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// set the size of a terminal, which sends SIGWINCH to its foreground process group
+func setPTYSize(f *os.File, size TermSize) error {
+	ws := winsize{Row: size.Rows, Col: size.Cols}
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// open a new pseudo-terminal of the given size, returning the server's end and the program's end
+func openPTY(size TermSize) (*os.File, *os.File, error) {
+	// O_NOCTTY, so that a server running as a session leader doesn't take the terminal
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var unlock int32
+	err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	err = setPTYSize(master, size)
+	if err != nil {
+		master.Close()
+		tty.Close()
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+// run a prepared command on a new pseudo-terminal, connecting the terminal to the job's
+// channels. The command has to make itself a session leader with the terminal as its
+// controlling terminal, if it needs one
+func runPTYCmd(ctx context.Context,
+	cancel context.CancelFunc,
+	proc *exec.Cmd,
+	job *Job,
+) error {
+	master, tty, err := openPTY(job.termSize())
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer master.Close()
+
+	proc.Stdin = tty
+	proc.Stdout = tty
+	proc.Stderr = tty
+	err = proc.Start()
+	// only the program should hold its end open, so that our reads end when it exits
+	tty.Close()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	// everything comes out of the terminal as stdout
+	close(job.Stderr)
+
+	controlCtx, stopControls := context.WithCancel(ctx)
+	defer stopControls()
+	go applyEach(controlCtx, job.Resize, job.logger(), func(size TermSize) error {
+		return setPTYSize(master, size)
+	})
+	go applyEach(controlCtx, job.Signals, job.logger(), func(sig syscall.Signal) error {
+		return proc.Process.Signal(sig)
+	})
+
+	pty := ptyMaster{master}
+	go inScanner(ctx, cancel, pty, ptyStdin(ctx, job.Stdin), job.logger())
+	outScanner(ctx, cancel, pty, job.Stdout, "stdout", job.logger())
+
+	return proc.Wait()
+}
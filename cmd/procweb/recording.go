@@ -0,0 +1,426 @@
+package procweb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordings
+// =====================================
+
+// the longest pause that a replay keeps. Longer ones, like a program waiting while its
+// student thinks, are cut short
+const maxReplayPause = 2 * time.Second
+
+// a Recorder keeps a recording of every run in Dir: an asciicast v2 file of its terminal,
+// named after the run's recording token with a .cast extension, and its RecordingMetadata
+// alongside it with a .json extension. The token isn't the run's ID, which viewers and the
+// logs see, so that only the client that started the run can get at its recording
+type Recorder struct {
+	Dir string
+}
+
+// a Recorder for dir, which is created if it's not there
+func NewRecorder(dir string) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make recording directory: %w", err)
+	}
+	return &Recorder{Dir: dir}, nil
+}
+
+// RecordingMetadata is what's kept about a run besides its terminal
+type RecordingMetadata struct {
+	ID       string `json:"id"`
+	Language string `json:"language"`
+	PTY      bool   `json:"pty"`
+	// the file the program started from, "" for the language's usual file
+	Entrypoint string `json:"entrypoint,omitempty"`
+	// the program as the client sent it
+	Files   []FileMessage `json:"files"`
+	Started time.Time     `json:"started"`
+	Exit    ExitStatus    `json:"exit"`
+	// which of the cast's events were written to stderr, counting from 0 after the header.
+	// asciicast has no code for stderr, so players show it as output like the terminal did
+	StderrEvents []int `json:"stderrEvents,omitempty"`
+}
+
+// the first line of an asciicast v2 file
+type castHeader struct {
+	Version   int    `json:"version"`
+	Width     uint16 `json:"width"`
+	Height    uint16 `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// every other line of an asciicast v2 file, which is written as a JSON array of its fields.
+// Codes are "o" for output, "i" for input and "r" for a resize, whose data is like "80x24".
+// asciicast has no code for stderr, so it's recorded as output, and listed in the metadata
+type castEvent struct {
+	Time float64
+	Code string
+	Data string
+}
+
+func (e castEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Code, e.Data})
+}
+
+func (e *castEvent) UnmarshalJSON(b []byte) error {
+	var fields []json.RawMessage
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("bad asciicast event %s", b)
+	}
+	for i, v := range []any{&e.Time, &e.Code, &e.Data} {
+		err = json.Unmarshal(fields[i], v)
+		if err != nil {
+			return fmt.Errorf("bad asciicast event %s: %w", b, err)
+		}
+	}
+	return nil
+}
+
+// whether token could have come from us, so that it's safe to use in a file name
+func validRecordingToken(token string) bool {
+	_, err := hex.DecodeString(token)
+	return token != "" && err == nil
+}
+
+// the path of the recording's files, without an extension
+func (rec *Recorder) path(token string) (string, error) {
+	if validRecordingToken(token) == false {
+		return "", fmt.Errorf("bad recording token %q", token)
+	}
+	return filepath.Join(rec.Dir, token), nil
+}
+
+// a recording in progress. Its methods do nothing on a nil recording, so runs that aren't
+// recorded don't have to check
+type recording struct {
+	token string
+	path  string
+	meta  RecordingMetadata
+	log   *slog.Logger
+
+	mtx  sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	// when the program started running. Events from before then are at 0
+	start time.Time
+	// how many events have been written
+	events int
+	// set after the first error, after which nothing more is written
+	err error
+}
+
+// start recording the run with the given ID, under program.Recording
+func (rec *Recorder) record(id string, config InstanceConfig, program Program) (*recording, error) {
+	path, err := rec.path(program.Recording)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".cast", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	r := &recording{
+		token: program.Recording,
+		path:  path,
+		meta: RecordingMetadata{
+			ID:         id,
+			Language:   config.Language.Name,
+			PTY:        config.PTY,
+			Entrypoint: program.Entrypoint,
+			Files:      program.Files.Messages(),
+			Started:    time.Now(),
+		},
+		log:  config.logger().With("instance", id),
+		file: file,
+		w:    bufio.NewWriter(file),
+	}
+	size := program.Size
+	if size.Rows == 0 || size.Cols == 0 {
+		size = defaultTermSize
+	}
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     size.Cols,
+		Height:    size.Rows,
+		Timestamp: r.meta.Started.Unix(),
+		Title:     fmt.Sprintf("%s %s", config.Language.Name, id),
+	})
+	r.write(header)
+	return r, nil
+}
+
+// write a line to the cast, unless something's already gone wrong. The caller holds the lock
+func (r *recording) write(line []byte) {
+	if r.err != nil {
+		return
+	}
+	r.w.Write(line)
+	r.err = r.w.WriteByte('\n')
+	if r.err != nil {
+		r.log.Error("failed to write recording, giving up on it", "err", r.err)
+	}
+}
+
+// the program's started running, so start the clock
+func (r *recording) begin() {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.start = time.Now()
+}
+
+func (r *recording) event(code string, data string) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.writeEvent(code, data)
+}
+
+// record the program's output, keeping track of what was written to stderr
+func (r *recording) output(msg ProcMessage) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if msg.Category == "stderr" {
+		r.meta.StderrEvents = append(r.meta.StderrEvents, r.events)
+	}
+	r.writeEvent("o", msg.Body)
+}
+
+// write an event to the cast. The caller holds the lock
+func (r *recording) writeEvent(code string, data string) {
+	event := castEvent{Code: code, Data: data}
+	if r.start.IsZero() == false {
+		event.Time = time.Since(r.start).Seconds()
+	}
+	line, _ := json.Marshal(event)
+	r.write(line)
+	r.events++
+}
+
+func (r *recording) resize(size TermSize) {
+	r.event("r", fmt.Sprintf("%dx%d", size.Cols, size.Rows))
+}
+
+// the run's over, so finish the cast and write the metadata alongside it
+func (r *recording) finish(status ExitStatus) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	r.file.Close()
+	if r.err != nil {
+		r.log.Error("failed to write recording", "err", r.err)
+		return
+	}
+	r.meta.Exit = status
+	meta, _ := json.MarshalIndent(r.meta, "", "\t")
+	err := os.WriteFile(r.path+".json", meta, 0o640)
+	if err != nil {
+		r.log.Error("failed to write recording metadata", "err", err)
+	}
+}
+
+// the run never started, so there's nothing worth keeping
+func (r *recording) discard() {
+	if r == nil {
+		return
+	}
+	r.file.Close()
+	os.Remove(r.path + ".cast")
+}
+
+// the metadata of a finished recording
+func (rec *Recorder) Metadata(token string) (RecordingMetadata, error) {
+	var meta RecordingMetadata
+	path, err := rec.path(token)
+	if err != nil {
+		return meta, err
+	}
+	b, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// the path of a finished recording's asciicast file
+func (rec *Recorder) CastPath(token string) (string, error) {
+	// a recording is only finished once its metadata is written
+	_, err := rec.Metadata(token)
+	if err != nil {
+		return "", err
+	}
+	path, _ := rec.path(token)
+	return path + ".cast", nil
+}
+
+// the events of a finished recording
+func (rec *Recorder) events(token string) ([]castEvent, error) {
+	path, err := rec.CastPath(token)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	if len(lines) == 0 {
+		return nil, errors.New("empty recording")
+	}
+	events := make([]castEvent, 0, len(lines)-1)
+	// the first line is the header
+	for _, line := range lines[1:] {
+		var event castEvent
+		err = json.Unmarshal(line, &event)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// the messages a replay sends for a recording's i'th event, as if the program was running
+// again. Input is only shown for programs that weren't on a terminal, since a terminal
+// echoes it as output already
+func replayMessages(meta RecordingMetadata, i int, event castEvent) []ProcMessage {
+	switch event.Code {
+	case "o":
+		if _, stderr := slices.BinarySearch(meta.StderrEvents, i); stderr {
+			return []ProcMessage{{Category: "stderr", Body: event.Data}}
+		}
+		return []ProcMessage{{Category: "stdout", Body: event.Data}}
+	case "i":
+		if meta.PTY == false {
+			return []ProcMessage{{Category: "stdin", Body: event.Data}}
+		}
+	}
+	return nil
+}
+
+// play the recording kept under token back to a client over ws, at the pace it was
+// recorded, as if the program was running again. The client says hello first, as usual, but
+// doesn't send a program. Input comes back as "stdin" messages, and the replay ends with
+// the program's exit status. log is where the replay logs, nil for ProcLog
+func ReplayRecording(ws *websocket.Conn, rec *Recorder, token string, log *slog.Logger) {
+	if log == nil {
+		log = ProcLog
+	}
+	var mtx sync.Mutex
+	var sent uint64
+	reject := func(err *ProtocolError) {
+		log.Info("protocol error", "err", err)
+		writeMessage(ws, &mtx, &sent, errorMessage(err))
+		shutdownWs(ws, &mtx)
+	}
+
+	msg, err := readProcMessage(ws)
+	if err != nil {
+		log.Info("client left before saying hello", "err", err)
+		shutdownWs(ws, &mtx)
+		return
+	}
+	if msg.Category != "hello" {
+		reject(protocolErrorf(ErrUnexpectedMessage, "hello has to be the first message"))
+		return
+	}
+	meta, err := rec.Metadata(token)
+	var events []castEvent
+	if err == nil {
+		events, err = rec.events(token)
+	}
+	// the welcome has the run's ID, like the run's own did
+	welcome, perr := negotiate(msg.Body, meta.ID)
+	if perr != nil {
+		reject(perr)
+		return
+	}
+	if err != nil {
+		log.Info("failed to load recording", "err", err)
+		reject(protocolErrorf(ErrNoRecording, "there's no such recording"))
+		return
+	}
+	log = log.With("instance", meta.ID)
+	body, _ := json.Marshal(welcome)
+	writeMessage(ws, &mtx, &sent, ProcMessage{Category: "welcome", Body: string(body)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan ProcMessage, 8)
+	// nothing the client sends matters, but reading notices when it goes
+	incoming := ScanProcConnection(ctx, cancel, ws, &mtx, log)
+	SendProcConnection(ctx, cancel, ws, &mtx, log, out, "replay")
+	defer func() {
+		// the sender closes the socket once it's sent everything, which ends the scanner
+		close(out)
+		for range incoming {
+		}
+	}()
+	send := func(msg ProcMessage) bool {
+		sent++
+		msg.Seq = sent
+		msg.Time = captureTime()
+		select {
+		case <-ctx.Done():
+			return false
+		case out <- msg:
+			return true
+		}
+	}
+
+	log.Info("replaying recording", "events", len(events))
+	var last float64
+	for i, event := range events {
+		pause := min(time.Duration((event.Time-last)*float64(time.Second)), maxReplayPause)
+		last = event.Time
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pause):
+			}
+		}
+		for _, msg := range replayMessages(meta, i, event) {
+			if send(msg) == false {
+				return
+			}
+		}
+	}
+	exit, _ := json.Marshal(meta.Exit)
+	send(ProcMessage{Category: "exit", Body: string(exit)})
+}
@@ -0,0 +1,168 @@
+package procweb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// run an echo program that's recorded, returning its welcome
+func recordEcho(t *testing.T, rec *Recorder) Welcome {
+	t.Helper()
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"], Recorder: rec}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "features": ["exit"]}`},
+		{Category: "code", Body: "print(io.read())"},
+		{Category: "EOF", Body: "code"},
+		{Category: "resize", Body: `{"rows": 30, "cols": 100}`},
+		{Category: "stdin", Body: "one\n"},
+		{Category: "EOF", Body: "stdin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitStatus(t, msgs)
+	var welcome Welcome
+	json.Unmarshal([]byte(msgs[0].Body), &welcome)
+	if welcome.Recording == "" || welcome.Recording == welcome.Instance {
+		t.Fatalf("expected a recording token, got %+v", welcome)
+	}
+	return welcome
+}
+
+func TestRecording(t *testing.T) {
+	rec, err := NewRecorder(filepath.Join(t.TempDir(), "recordings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	welcome := recordEcho(t, rec)
+
+	meta, err := rec.Metadata(welcome.Recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the code's kept as it was sent, without the prelude
+	if meta.ID != welcome.Instance || meta.Language != "luajit" || len(meta.Files) != 1 || meta.Files[0].Content != "print(io.read())" {
+		t.Errorf("bad metadata %+v", meta)
+	}
+	if meta.Exit.Code != 0 || meta.Exit.Description != "exited normally" {
+		t.Errorf("bad exit %+v", meta.Exit)
+	}
+
+	path, err := rec.CastPath(welcome.Recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 || header.Width != 80 || header.Height != 24 {
+		t.Errorf("bad header %s", scanner.Bytes())
+	}
+	var events []castEvent
+	for scanner.Scan() {
+		var event castEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > 0 && event.Time < events[len(events)-1].Time {
+			t.Errorf("%+v went back in time", event)
+		}
+		events = append(events, event)
+	}
+	want := []castEvent{{Code: "r", Data: "100x30"}, {Code: "i", Data: "one\n"}, {Code: "o", Data: "one\n"}}
+	if len(events) != len(want) {
+		t.Fatalf("want %+v, got %+v", want, events)
+	}
+	for i := range want {
+		if events[i].Code != want[i].Code || events[i].Data != want[i].Data {
+			t.Errorf("want %+v, got %+v", want[i], events[i])
+		}
+	}
+
+	if _, err := rec.Metadata("../" + welcome.Recording); err == nil {
+		t.Errorf("a recording was found outside of the directory")
+	}
+	// the run's ID is no good for getting at it, since viewers know that too
+	if _, err := rec.Metadata(welcome.Instance); err == nil {
+		t.Errorf("a recording was found by its run's ID")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rec, err := NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := recordEcho(t, rec)
+
+	ws, instanceSock := createSockets()
+	go ReplayRecording(instanceSock, rec, recorded.Recording, nil)
+	welcome := helloInstance(t, ws, Hello{Version: 1})
+	if welcome.Instance != recorded.Instance || welcome.Recording != "" {
+		t.Errorf("replaying the wrong recording %+v", welcome)
+	}
+	msgs := readRest(t, ws)
+	if combineCategory(msgs, "stdin").Body != "one\n" || combineCategory(msgs, "stdout").Body != "one\n" {
+		t.Errorf("bad replay %v", msgs)
+	}
+	if exit := exitStatus(t, msgs); exit.Description != "exited normally" {
+		t.Errorf("bad exit %+v", exit)
+	}
+
+	ws, instanceSock = createSockets()
+	go ReplayRecording(instanceSock, rec, recorded.Instance, nil)
+	writeProcMessage(ws, ProcMessage{Category: "hello", Body: `{"version": 1}`})
+	if msgs := readRest(t, ws); len(msgs) != 1 || protocolErrorCode(msgs[0]) != ErrNoRecording {
+		t.Errorf("expected a no_recording error, got %v", msgs)
+	}
+}
+
+func TestReplayStderr(t *testing.T) {
+	rec, err := NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeInterleaved}, Language: Languages["luajit"], Recorder: rec}
+	result, err := RunBatch(context.Background(), config, Program{Files: NewWorkspace(), Recording: "abcd"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := rec.Metadata("abcd"); err != nil || len(meta.StderrEvents) == 0 {
+		t.Errorf("stderr wasn't kept apart: %+v, %v", meta, err)
+	}
+
+	ws, instanceSock := createSockets()
+	go ReplayRecording(instanceSock, rec, "abcd", nil)
+	helloInstance(t, ws, Hello{Version: 1})
+	msgs := readRest(t, ws)
+	if combineCategory(msgs, "stdout").Body != result.Stdout || combineCategory(msgs, "stderr").Body != result.Stderr {
+		t.Errorf("bad replay %v of %+v", msgs, result)
+	}
+}
+
+func TestBatchRecording(t *testing.T) {
+	rec, err := NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"], Recorder: rec}
+	result, err := RunBatch(context.Background(), config, Program{ID: "abcd", Files: NewWorkspace()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recording == "" || result.Recording == "abcd" {
+		t.Fatalf("expected a recording token, got %+v", result)
+	}
+	if meta, err := rec.Metadata(result.Recording); err != nil || meta.ID != "abcd" || meta.Exit.Code != 0 {
+		t.Errorf("the batch run wasn't recorded: %+v, %v", meta, err)
+	}
+}
@@ -0,0 +1,405 @@
+package procweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// running programs
+// =====================================
+
+// a Program is what a client sends to be run
+type Program struct {
+	// identifies the run, like in the server's logs and its recording. "" for a new ID
+	ID    string
+	Files *Workspace
+	// what the run's recording is kept under, if it's recorded. Anyone with it can see the
+	// run, so only the client that sent the program is told it. "" for a new token
+	Recording string
+	// the file the program starts from, "" for the language's usual file
+	Entrypoint string
+	// the size of the client's terminal, zero if it didn't say
+	Size TermSize
+}
+
+// the body of a "queued" message, sent while a program waits for its turn to run
+type QueuedMessage struct {
+	// the program's place in the queue, 1 for next in line
+	Position int `json:"position"`
+}
+
+// a Run is one program running. Websocket instances and the HTTP API both go through it,
+// so that programs run the same way whichever one a client uses
+type Run struct {
+	// the program's stdin. Close it to end the program's input. Sends should also wait on
+	// Finished, since nothing reads this once the program is done
+	Stdin chan []byte
+	// the program's output, as limited by the run's output limit. Before the output come
+	// "queued" messages if the program has to wait for its turn. After it come a "limit"
+	// message if a limit stopped the program, and then an "exit" message with its
+	// ExitStatus, before this is closed
+	Output chan ProcMessage
+
+	resize   chan TermSize
+	signals  chan syscall.Signal
+	finished chan struct{}
+	// lasts as long as the program
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	admission *Admission
+	ticket    *admissionTicket
+
+	killGrace   time.Duration
+	terminating sync.Once
+	// has the run's ID
+	log *slog.Logger
+	// nil if the run isn't being recorded
+	recording *recording
+	metrics   *Metrics
+	// whether the client had the program killed, rather than it exiting on its own
+	killed atomic.Bool
+	// whether the client sent the program a signal, like SIGINT for ^C
+	signalled atomic.Bool
+
+	status ExitStatus
+}
+
+// write program to a new directory and start running it, once config.Admission lets it.
+// The run stops early if ctx is cancelled, which also stops its output. If too many
+// programs are already waiting, it returns ErrQueueFull
+func StartRun(ctx context.Context, config InstanceConfig, program Program) (*Run, error) {
+	lang := config.Language.WithEntrypoint(program.Entrypoint)
+	files := program.Files
+	if files.Has(lang.FileName) == false {
+		if program.Entrypoint != "" {
+			return nil, protocolErrorf(ErrBadMessage, "the entrypoint %q isn't one of the program's files", program.Entrypoint)
+		}
+		files.Append(lang.FileName, "")
+	}
+	id := program.ID
+	if id == "" {
+		id = newInstanceID()
+	}
+	log := config.logger().With("instance", id)
+	// the recording gets the program as the client sent it, without the prelude
+	var rec *recording
+	if config.Recorder != nil {
+		var err error
+		if program.Recording == "" {
+			program.Recording = newToken()
+		}
+		rec, err = config.Recorder.record(id, config, program)
+		if err != nil {
+			// the program can still run without one
+			log.Warn("not recording", "err", err)
+		}
+	}
+	// a terminal already flushes output as it's written
+	if config.PTY == false {
+		files.Prepend(lang.FileName, lang.Prelude)
+	}
+	log.Debug("program", userContent("files", files.String()))
+
+	dir, err := os.MkdirTemp("/tmp", "source-")
+	if err != nil {
+		rec.discard()
+		return nil, fmt.Errorf("failed to make directory for program files: %w", err)
+	}
+	err = files.WriteTo(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		rec.discard()
+		return nil, fmt.Errorf("failed to write program files: %w", err)
+	}
+	ticket, err := config.Admission.enqueue()
+	if err != nil {
+		os.RemoveAll(dir)
+		rec.discard()
+		return nil, err
+	}
+
+	killGrace := config.KillGrace
+	if killGrace == 0 {
+		killGrace = DefaultKillGrace
+	}
+	runCtx, cancelRun := context.WithCancel(ctx)
+	r := &Run{
+		Stdin:  make(chan []byte, 8),
+		Output: make(chan ProcMessage, 8),
+		// only the latest size matters, so this holds at most one
+		resize:    make(chan TermSize, 1),
+		signals:   make(chan syscall.Signal, 4),
+		finished:  make(chan struct{}),
+		ctx:       runCtx,
+		cancel:    cancelRun,
+		admission: config.Admission,
+		ticket:    ticket,
+		killGrace: killGrace,
+		log:       log,
+		recording: rec,
+		metrics:   config.Metrics,
+	}
+	job := Job{
+		Dir:      dir,
+		Language: lang,
+		Limits:   config.Limits,
+		PTY:      config.PTY,
+		Size:     program.Size,
+		Resize:   r.resize,
+		Signals:  r.signals,
+		Stdin:    r.Stdin,
+		Stdout:   make(chan ProcMessage, 8),
+		Stderr:   make(chan ProcMessage, 8),
+		Log:      log,
+	}
+	if rec != nil || r.metrics != nil {
+		job.Stdin = tapInput(runCtx, r.Stdin, func(msg []byte) {
+			r.recording.event("i", string(msg))
+			r.metrics.input(msg)
+		})
+	}
+	r.metrics.started()
+	go r.run(ctx, config, &job)
+	return r, nil
+}
+
+// run the job and report how it went on Output
+func (r *Run) run(ctx context.Context, config InstanceConfig, job *Job) {
+	defer close(r.Output)
+	defer os.RemoveAll(job.Dir)
+	defer r.cancel()
+
+	// wait for a turn to run, which is also when the program's limits start counting
+	err := r.admission.wait(r.ctx, r.ticket, func(position int) {
+		body, _ := json.Marshal(QueuedMessage{Position: position})
+		select {
+		case <-ctx.Done():
+		case r.Output <- ProcMessage{Category: "queued", Body: string(body)}:
+		}
+	})
+	if err != nil {
+		r.log.Info("program never ran", "err", err)
+		close(r.finished)
+		r.metrics.finished(job.Language.Name, reasonNeverRan, 0)
+		r.exit(ctx, newExitStatus(err, r.killed.Load(), "", 0, Usage{}))
+		return
+	}
+	r.recording.begin()
+	r.log.Info("program started", "language", job.Language.Name, "pty", job.PTY)
+
+	var limits limitTracker
+	if config.Limits.WallClock != 0 {
+		timer := time.AfterFunc(config.Limits.WallClock, func() {
+			limits.exceed(LimitKindWall, fmt.Sprintf("time limit exceeded (%s)", config.Limits.WallClock), r.cancel)
+		})
+		defer timer.Stop()
+	}
+
+	// the program's output is joined up into fewer messages, stops the program if there's
+	// too much of it, and is cut short if there's too much to send
+	var dropped int64
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	limited := make(chan ProcMessage, 8)
+	go func() {
+		defer outputDone.Done()
+		defer close(limited)
+		merged := coalesceOutput(ctx, mergeOutput(ctx, job.Stdout, job.Stderr), coalesceWindow, maxCoalescedSize)
+		limitOutput(ctx, merged, limited, config.Limits.Output, &limits, r.cancel)
+	}()
+	go func() {
+		defer outputDone.Done()
+		// the recording and metrics have everything up to the output limit, even what isn't sent
+		toSend := limited
+		if r.recording != nil || r.metrics != nil {
+			toSend = tapOutput(ctx, limited, func(msg ProcMessage) {
+				if msg.Category == "stdout" || msg.Category == "stderr" {
+					r.recording.output(msg)
+				}
+				r.metrics.output(msg)
+			})
+		}
+		dropped = truncateOutput(ctx, toSend, r.Output, config.Limits.Truncate)
+	}()
+
+	start := time.Now()
+	err = config.Runner.Run(r.ctx, r.cancel, job)
+	wall := time.Since(start)
+	if err != nil {
+		r.log.Debug("runner stopped", "err", err)
+	}
+	r.admission.leave(r.ticket)
+
+	// if we didn't stop the program ourselves, check whether the system did
+	if r.ctx.Err() == nil {
+		if limit := exitLimit(err, config.Limits, job.Usage); limit != nil {
+			limits.exceed(limit.Kind, limit.Reason, r.cancel)
+		}
+	}
+	close(r.finished)
+	r.cancel()
+
+	// say which limit stopped the program and how it ended, after all of its output
+	outputDone.Wait()
+	limitKind, reason := limits.get()
+	if reason != "" {
+		select {
+		case <-ctx.Done():
+		case r.Output <- ProcMessage{Category: "limit", Body: reason}:
+		}
+	}
+	status := newExitStatus(err, r.killed.Load(), reason, wall, job.Usage)
+	status.OutputDropped = dropped
+	r.metrics.finished(job.Language.Name, exitReason(status, limitKind, r.killed.Load(), r.signalled.Load()), wall)
+	r.exit(ctx, status)
+}
+
+// say how the run ended, as its last message
+func (r *Run) exit(ctx context.Context, status ExitStatus) {
+	r.status = status
+	r.recording.finish(status)
+	r.log.Info("program exited",
+		"code", status.Code,
+		"signal", status.Signal,
+		"limit", status.Limit,
+		"wall_time", status.WallTime,
+		"output_dropped", status.OutputDropped,
+	)
+	exit, err := json.Marshal(status)
+	if err != nil {
+		r.log.Error("failed to encode exit status", "err", err)
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case r.Output <- ProcMessage{Category: "exit", Body: string(exit)}:
+	}
+}
+
+// closed once the program has exited. Its output can still be on its way
+func (r *Run) Finished() <-chan struct{} {
+	return r.finished
+}
+
+// what the run's recording is kept under, "" if it isn't being recorded
+func (r *Run) Recording() string {
+	if r.recording == nil {
+		return ""
+	}
+	return r.recording.token
+}
+
+// how the program ended. Only call this once Output is closed
+func (r *Run) Status() ExitStatus {
+	return r.status
+}
+
+// change the size of the program's terminal. Don't call it from more than one goroutine
+func (r *Run) Resize(size TermSize) {
+	// replace a size the runner hasn't picked up yet
+	select {
+	case <-r.resize:
+	default:
+	}
+	r.resize <- size
+	r.recording.resize(size)
+}
+
+// send a signal to the program. SIGKILL kills it outright, and a program that ignores
+// SIGTERM is killed once its grace period is up. A program still waiting for its turn
+// doesn't get to run at all
+func (r *Run) Signal(sig syscall.Signal) {
+	// cancelling is how every runner kills a program
+	if sig == syscall.SIGKILL || r.started() == false {
+		r.kill()
+		return
+	}
+	select {
+	case <-r.ctx.Done():
+		return
+	case r.signals <- sig:
+		r.signalled.Store(true)
+	}
+	if sig == syscall.SIGTERM {
+		r.terminating.Do(func() {
+			go func() {
+				select {
+				case <-r.ctx.Done():
+				case <-time.After(r.killGrace):
+					r.log.Info("program outlived its grace period, killing it")
+					r.kill()
+				}
+			}()
+		})
+	}
+}
+
+// whether the program's turn to run has come
+func (r *Run) started() bool {
+	if r.ticket == nil {
+		return true
+	}
+	select {
+	case <-r.ticket.admitted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Run) kill() {
+	r.killed.Store(true)
+	r.cancel()
+}
+
+// pass the program's input on, calling f with each message on its way through. The returned
+// channel is closed once in is, or ctx is done
+func tapInput(ctx context.Context, in chan []byte, f func(msg []byte)) chan []byte {
+	out := make(chan []byte, 8)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-in:
+				if ok == false {
+					return
+				}
+				f(msg)
+				select {
+				case <-ctx.Done():
+					return
+				case out <- msg:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// pass the program's output on, calling f with each message on its way through. The
+// returned channel is closed once in is, or ctx is done
+func tapOutput(ctx context.Context, in chan ProcMessage, f func(msg ProcMessage)) chan ProcMessage {
+	out := make(chan ProcMessage, 8)
+	go func() {
+		defer close(out)
+		for msg := range in {
+			f(msg)
+			select {
+			case <-ctx.Done():
+				return
+			case out <- msg:
+			}
+		}
+	}()
+	return out
+}
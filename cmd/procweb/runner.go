@@ -0,0 +1,311 @@
+package procweb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// a Job is everything a Runner needs to run one program
+type Job struct {
+	// the directory holding the program's source files
+	Dir string
+	// the language the program is written in
+	Language Language
+	// the resources the program may use. The instance enforces the wall clock and output
+	// limits itself, runners should enforce the rest as well as their backend allows
+	Limits Limits
+	// run the program on a pseudo-terminal instead of pipes. The terminal does echo and line
+	// editing, and merges stderr into stdout, so the Runner only sends output on Stdout.
+	// Runners that can't make a terminal ignore this
+	PTY bool
+	// the size of the client's terminal when the program starts, zero if the client didn't say
+	Size TermSize
+	// new sizes of the client's terminal while the program runs. Runners with a terminal
+	// apply them, others can ignore them. It is never closed
+	Resize chan TermSize
+	// signals from the client, SIGINT or SIGTERM, for the Runner to deliver to the program's
+	// processes. The instance kills programs by cancelling the run instead. It is never closed
+	Signals chan syscall.Signal
+
+	// the Runner reads stdin from Stdin and writes program output to Stdout and Stderr.
+	// Stdout and Stderr are closed by the Runner once the matching output stream ends
+	Stdin  chan []byte
+	Stdout chan ProcMessage
+	Stderr chan ProcMessage
+
+	// what the program used, set by the Runner before Run returns if its backend can measure it
+	Usage Usage
+
+	// where the Runner logs about the program, which has the run's ID. nil means ProcLog
+	Log *slog.Logger
+}
+
+func (j *Job) logger() *slog.Logger {
+	if j.Log == nil {
+		return ProcLog
+	}
+	return j.Log
+}
+
+// the resources a program used. Zero fields weren't measured
+type Usage struct {
+	// user and system CPU time of the program and all of its processes
+	CPUTime time.Duration
+	// the peak resident memory of the program's largest process, in bytes
+	PeakMemory int64
+}
+
+// a Runner is an execution backend: it starts a job's program and connects its stdio
+// to the job's channels. Run blocks until the program has exited, and returns the
+// program's exit error, if there was one
+type Runner interface {
+	Run(ctx context.Context, cancel context.CancelFunc, job *Job) error
+}
+
+// a Reaper is a Runner whose programs can outlive it on the host, like docker containers
+type Reaper interface {
+	// remove everything left behind by instances from earlier runs of the server
+	Reap(ctx context.Context) error
+	// stop and remove everything belonging to instances that are still running
+	Close() error
+}
+
+// TermSize is the size of the client's terminal, in characters
+type TermSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// the terminal size for jobs whose client didn't say
+var defaultTermSize = TermSize{Rows: 24, Cols: 80}
+
+// the size of the job's terminal when the program starts
+func (j *Job) termSize() TermSize {
+	if j.Size.Rows == 0 || j.Size.Cols == 0 {
+		return defaultTermSize
+	}
+	return j.Size
+}
+
+// environment variables telling a program on pipes the size of the client's terminal.
+// Programs on a terminal can ask it instead, and curses would let these override the
+// terminal's own size as it changes, so they don't get them
+func termEnv(job *Job) []string {
+	if job.PTY {
+		return nil
+	}
+	size := job.termSize()
+	return []string{fmt.Sprintf("LINES=%d", size.Rows), fmt.Sprintf("COLUMNS=%d", size.Cols)}
+}
+
+// apply every value sent on in, like terminal sizes or signals, until ctx is done.
+// Failures are only logged to log, since the program may have just exited
+func applyEach[T any](ctx context.Context, in chan T, log *slog.Logger, apply func(T) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-in:
+			err := apply(v)
+			if err != nil {
+				log.Warn("failed to apply a change to the program", "change", v, "err", err)
+			}
+		}
+	}
+}
+
+// the end of input for a program on a terminal is a ^D, which the terminal turns into EOF.
+// Closing the terminal instead would hang up on the program.
+// The returned channel is closed once ctx is done
+func ptyStdin(ctx context.Context, in chan []byte) chan []byte {
+	out := make(chan []byte, 8)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-in:
+				if ok == false {
+					msg = []byte{4}
+					in = nil
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- msg:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// give up on a job before its program started. Nothing will read the program's output, so
+// close the output channels here to let the instance finish
+func abortJob(cancel context.CancelFunc, job *Job, err error) error {
+	cancel()
+	close(job.Stdout)
+	close(job.Stderr)
+	return err
+}
+
+// run a prepared command, connecting its stdio to the job's channels
+func runCmd(ctx context.Context,
+	cancel context.CancelFunc,
+	proc *exec.Cmd,
+	job *Job,
+) error {
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	stderr, err := proc.StderrPipe()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	err = proc.Start()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	signalCtx, stopSignals := context.WithCancel(ctx)
+	defer stopSignals()
+	go applyEach(signalCtx, job.Signals, job.logger(), func(sig syscall.Signal) error {
+		return proc.Process.Signal(sig)
+	})
+
+	// write to stdin pipe
+	go inScanner(ctx, cancel, stdin, job.Stdin, job.logger())
+
+	// read from the output pipes. proc.Wait closes the pipes, so we can't call it until
+	// both scanners are done reading
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stdout, job.Stdout, "stdout", job.logger())
+	}()
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stderr, job.Stderr, "stderr", job.logger())
+	}()
+	wg.Wait()
+
+	return proc.Wait()
+}
+
+// FakeRunner runs a Go function in-process in place of the real program.
+// It's useful for testing NewInstance without docker. It has no terminals, so PTY jobs
+// run on pipes like any other, and any signal stops the program by cancelling its context
+type FakeRunner struct {
+	// the "program". It gets the job's source directory and the program's stdio.
+	// If it is nil, the fake runner echoes stdin back to stdout, like cat
+	Program func(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+}
+
+// copy stdin to stdout until stdin ends
+func catProgram(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	_, err := io.Copy(stdout, stdin)
+	return err
+}
+
+// a FakeRunner program that prints the job's source files, then echoes stdin
+func EchoSourceProgram(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		src, err := os.ReadFile(path.Join(dir, v.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = stdout.Write(src)
+		if err != nil {
+			return err
+		}
+	}
+	return catProgram(ctx, dir, stdin, stdout, stderr)
+}
+
+func (r FakeRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	program := r.Program
+	if program == nil {
+		program = catProgram
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+
+	go inScanner(ctx, cancel, stdinWriter, job.Stdin, job.logger())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stdoutReader, job.Stdout, "stdout", job.logger())
+	}()
+	go func() {
+		defer wg.Done()
+		outScanner(ctx, cancel, stderrReader, job.Stderr, "stderr", job.logger())
+	}()
+
+	// a signal stops the program, like it would a program that doesn't handle it
+	programCtx, stopProgram := context.WithCancel(ctx)
+	defer stopProgram()
+	signalled := make(chan syscall.Signal, 1)
+	go func() {
+		select {
+		case <-programCtx.Done():
+		case sig := <-job.Signals:
+			signalled <- sig
+			stopProgram()
+		}
+	}()
+
+	// unblock the program's stdin reads if the instance gets cancelled
+	stop := context.AfterFunc(programCtx, func() {
+		stdinReader.CloseWithError(programCtx.Err())
+	})
+	defer stop()
+
+	err := program(programCtx, job.Dir, stdinReader, stdoutWriter, stderrWriter)
+	stdinReader.Close()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	wg.Wait()
+
+	select {
+	case sig := <-signalled:
+		return &SignalError{Signal: sig}
+	default:
+	}
+	return err
+}
+
+// change the owner of everything under dir
+func chownTree(dir string, uid int, gid int) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
@@ -0,0 +1,738 @@
+//go:build linux && (amd64 || arm64)
+
+package procweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The sandbox runs in three processes:
+//  1. the server, which starts (2) in new user, mount, pid, network, ipc and uts namespaces
+//  2. the sandbox init, a re-exec of the server binary that builds the sandbox's filesystem,
+//     then stays around as pid 1 to forward signals and reap zombies
+//  3. the sandbox exec, another re-exec that drops privileges, sets rlimits and the seccomp
+//     filter, then execs the student's program in its place
+//
+// (2) and (3) are recognized by their argv[0] when the binary starts
+
+const sandboxInitName string = "procweb-sandbox-init"
+const sandboxExecName string = "procweb-sandbox-exec"
+
+// where the sandbox init binary is mounted inside the sandbox
+const sandboxInitPath string = "/.sandbox-init"
+
+// the sandbox init writes a sandboxReport to this file descriptor as it exits
+const sandboxReportFd uintptr = 3
+
+// how the program went, from the sandbox init
+type sandboxReport struct {
+	Usage Usage
+	// the signal that killed the program, 0 if it exited. The init can only exit with
+	// 128+signal, which the program could have done itself
+	Signal syscall.Signal
+}
+
+// the user the program runs as inside the sandbox
+const sandboxUID int = 65534
+const sandboxGID int = 65534
+
+// when the server is root, every running program gets its own host user and group from
+// this range, since RLIMIT_NPROC counts all of a host user's processes, in every sandbox
+const sandboxFirstHostID int = 1 << 20
+const sandboxHostIDCount int = 1 << 16
+
+// the host ids handed out to running sandboxes
+var sandboxHostIDPool = struct {
+	mtx  sync.Mutex
+	used map[int]bool
+	next int
+}{used: map[int]bool{}}
+
+// host paths mounted read-only in the sandbox when SandboxRunner.Mounts is nil. Of /etc,
+// only what the interpreters need: the dynamic linker's cache, the alternatives that
+// commands like cc link through and the time zone. The sandbox gets its own passwd and group
+var DefaultSandboxMounts = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/localtime",
+}
+
+// the sandbox's /etc/passwd and /etc/group, unless the host's are mounted
+var sandboxPasswd = fmt.Sprintf("root:x:0:0:root:/tmp:/bin/sh\nnobody:x:%d:%d:nobody:/tmp:/bin/sh\n", sandboxUID, sandboxGID)
+var sandboxGroup = fmt.Sprintf("root:x:0:\nnogroup:x:%d:\n", sandboxGID)
+
+// device files bound into the sandbox's /dev
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+// SandboxRunner runs programs directly on the host, without docker, isolated with linux
+// namespaces, a private read-only root filesystem, rlimits, no network and a seccomp filter.
+// The programs' interpreters and compilers must be installed on the host
+type SandboxRunner struct {
+	// host directories mounted read-only in the sandbox. DefaultSandboxMounts if nil
+	Mounts []string
+
+	// rlimits for the program that aren't part of an instance's Limits. zero means use the default
+	FileBytes uint64 // RLIMIT_FSIZE, 16 MiB if zero
+	OpenFiles uint64 // RLIMIT_NOFILE, 64 if zero
+}
+
+// the sandbox init's configuration, passed as JSON in argv[1]
+type sandboxConfig struct {
+	Root    string
+	Dir     string
+	Mounts  []string
+	Limits  sandboxLimits
+	Command []string
+	// the program's stdio is a terminal, which it should take as its controlling terminal
+	PTY bool
+	// extra environment variables for the program
+	Env []string
+}
+
+// rlimits applied by the sandbox exec. zero means unlimited
+type sandboxLimits struct {
+	CPUSeconds  uint64
+	MemoryBytes uint64
+	Processes   uint64
+	FileBytes   uint64
+	OpenFiles   uint64
+}
+
+func init() {
+	switch os.Args[0] {
+	case sandboxInitName:
+		os.Exit(sandboxInit())
+	case sandboxExecName:
+		os.Exit(sandboxExec())
+	}
+}
+
+// pick v, or def if v is zero
+func orDefault(v uint64, def uint64) uint64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func (r SandboxRunner) limits(limits Limits) sandboxLimits {
+	return sandboxLimits{
+		CPUSeconds:  cpuSeconds(limits.CPUTime),
+		MemoryBytes: uint64(limits.Memory),
+		Processes:   uint64(limits.Processes),
+		FileBytes:   orDefault(r.FileBytes, 16<<20),
+		OpenFiles:   orDefault(r.OpenFiles, 64),
+	}
+}
+
+// the host user and group that the sandbox user maps to, and a function that gives them
+// back once the sandbox is gone. When the server runs as root, each sandbox gets unused ids
+// of its own, otherwise it's the server's own user, the only one it can map
+func sandboxHostIDs() (int, int, func(), error) {
+	if os.Getuid() != 0 {
+		return os.Getuid(), os.Getgid(), func() {}, nil
+	}
+
+	pool := &sandboxHostIDPool
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	// take them in turn, so that a sandbox's last processes are gone before its ids come round again
+	for range sandboxHostIDCount {
+		id := sandboxFirstHostID + pool.next
+		pool.next = (pool.next + 1) % sandboxHostIDCount
+		if pool.used[id] {
+			continue
+		}
+		pool.used[id] = true
+		release := func() {
+			pool.mtx.Lock()
+			defer pool.mtx.Unlock()
+			delete(pool.used, id)
+		}
+		return id, id, release, nil
+	}
+	return 0, 0, nil, errors.New("too many sandboxes running")
+}
+
+// namespace settings for starting the sandbox init.
+//
+// A root server maps root into the sandbox too, so the init can run the server binary
+// wherever it is, and only the program runs as the sandbox user. Any other user can only map
+// itself, so the init runs as the sandbox user and keeps CAP_SYS_ADMIN as an ambient
+// capability until the sandbox exec clears it
+func sandboxSysProcAttr(hostUID int, hostGID int) *syscall.SysProcAttr {
+	attr := syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+
+	if os.Getuid() == 0 {
+		attr.UidMappings = []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: 0, Size: 1},
+			{ContainerID: sandboxUID, HostID: hostUID, Size: 1},
+		}
+		attr.GidMappings = []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: 0, Size: 1},
+			{ContainerID: sandboxGID, HostID: hostGID, Size: 1},
+		}
+		return &attr
+	}
+
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: sandboxUID, HostID: hostUID, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: sandboxGID, HostID: hostGID, Size: 1}}
+	attr.Credential = &syscall.Credential{Uid: uint32(sandboxUID), Gid: uint32(sandboxGID), NoSetGroups: true}
+	attr.AmbientCaps = []uintptr{capSysAdmin}
+	return &attr
+}
+
+func (r SandboxRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	self, err := os.Executable()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	hostUID, hostGID, releaseIDs, err := sandboxHostIDs()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer releaseIDs()
+	// the program needs to be able to read its source files
+	if hostUID != os.Getuid() {
+		err = chownTree(job.Dir, hostUID, hostGID)
+		if err != nil {
+			return abortJob(cancel, job, err)
+		}
+	}
+
+	// an empty directory to mount the sandbox's root on
+	root, err := os.MkdirTemp("", "sandbox-")
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer os.RemoveAll(root)
+
+	mounts := r.Mounts
+	if mounts == nil {
+		mounts = DefaultSandboxMounts
+	}
+	config, err := json.Marshal(sandboxConfig{
+		Root:    root,
+		Dir:     job.Dir,
+		Mounts:  mounts,
+		Limits:  r.limits(job.Limits),
+		Command: job.Language.Command(),
+		PTY:     job.PTY,
+		Env:     termEnv(job),
+	})
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+
+	reportReader, reportWriter, err := os.Pipe()
+	if err != nil {
+		return abortJob(cancel, job, err)
+	}
+	defer reportReader.Close()
+
+	proc := exec.CommandContext(ctx, self, string(config))
+	proc.Args[0] = sandboxInitName
+	proc.Env = []string{}
+	proc.SysProcAttr = sandboxSysProcAttr(hostUID, hostGID)
+	proc.ExtraFiles = []*os.File{reportWriter}
+
+	if job.PTY {
+		err = runPTYCmd(ctx, cancel, proc, job)
+	} else {
+		err = runCmd(ctx, cancel, proc, job)
+	}
+
+	// the init has exited, so closing our end leaves only what it wrote. It writes nothing
+	// if it was killed or failed to start the program
+	reportWriter.Close()
+	var report sandboxReport
+	if json.NewDecoder(reportReader).Decode(&report) == nil {
+		job.Usage = report.Usage
+		var exitErr *exec.ExitError
+		if report.Signal != 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == 128+int(report.Signal) {
+			err = &SignalError{Signal: report.Signal}
+		}
+		// RLIMIT_AS only makes allocations fail, and programs die of that in their own ways.
+		// So a program that failed after using most of its memory is put down to the limit,
+		// unless the CPU limit stopped it
+		if ctx.Err() == nil && err != nil && job.Limits.Memory != 0 &&
+			report.Usage.PeakMemory >= job.Limits.Memory/4*3 && exitLimit(err, job.Limits, job.Usage) == nil {
+			err = memoryLimitError(job.Limits)
+		}
+	}
+	return err
+}
+
+// sandbox init
+// =====================================
+
+const capSysAdmin uintptr = 21
+
+// flags that a read-only bind mount has to keep from the mount it copies.
+// they have the same values in statfs and mount
+const lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// report an error from inside the sandbox. It goes to the program's stderr, so keep it short
+func sandboxFail(stage string, err error) int {
+	fmt.Fprintf(os.Stderr, "sandbox: %s: %s\n", stage, err)
+	return 125
+}
+
+// bind mount src onto dst, read-only unless writable is set
+func bindMount(src string, dst string, writable bool) error {
+	err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(dst, &stat)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(stat.Flags)&lockedMountFlags | syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_NOSUID
+	// device files only work on mounts that allow devices
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		flags |= syscall.MS_NODEV
+	}
+	if writable == false {
+		flags |= syscall.MS_RDONLY
+	}
+	return syscall.Mount("", dst, "", flags, "")
+}
+
+// make a copy of the host path p under root. Directories and files are bind mounted,
+// symlinks (like /bin -> usr/bin) are copied as symlinks
+func mountHostPath(root string, p string) error {
+	info, err := os.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(root, p)
+	err = os.MkdirAll(path.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case info.IsDir():
+		err = os.Mkdir(target, 0o755)
+	default:
+		err = os.WriteFile(target, []byte{}, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	return bindMount(p, target, false)
+}
+
+// build the sandbox's filesystem under config.Root and switch to it
+func setupSandboxFs(config sandboxConfig, self string) error {
+	// keep our mounts from propagating back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("private /: %w", err)
+	}
+
+	root := config.Root
+	err = syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m,mode=755")
+	if err != nil {
+		return fmt.Errorf("root tmpfs: %w", err)
+	}
+
+	for _, v := range config.Mounts {
+		err = mountHostPath(root, v)
+		if err != nil {
+			return fmt.Errorf("mount %s: %w", v, err)
+		}
+	}
+	for _, v := range sandboxDevices {
+		err = mountHostPath(root, v)
+		if err != nil {
+			return fmt.Errorf("mount %s: %w", v, err)
+		}
+	}
+
+	for _, v := range []struct {
+		path     string
+		contents string
+	}{{"/etc/passwd", sandboxPasswd}, {"/etc/group", sandboxGroup}} {
+		target := path.Join(root, v.path)
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+		err = os.MkdirAll(path.Dir(target), 0o755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(target, []byte(v.contents), 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the program's source, the only place it can write besides /tmp
+	err = os.Mkdir(path.Join(root, "source"), 0o755)
+	if err != nil {
+		return err
+	}
+	err = bindMount(config.Dir, path.Join(root, "source"), true)
+	if err != nil {
+		return fmt.Errorf("mount source: %w", err)
+	}
+
+	err = os.Mkdir(path.Join(root, "tmp"), 0o1777)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", path.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=16m,mode=1777")
+	if err != nil {
+		return fmt.Errorf("tmp tmpfs: %w", err)
+	}
+
+	// this can fail when the host's /proc is partially masked, like inside docker.
+	// Most programs don't need it, so carry on without one
+	err = os.Mkdir(path.Join(root, "proc"), 0o555)
+	if err != nil {
+		return err
+	}
+	_ = syscall.Mount("proc", path.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	// ourselves, so that we can start the sandbox exec once the host filesystem is gone
+	err = os.WriteFile(path.Join(root, sandboxInitPath), []byte{}, 0o755)
+	if err != nil {
+		return err
+	}
+	err = bindMount(self, path.Join(root, sandboxInitPath), false)
+	if err != nil {
+		return fmt.Errorf("mount init: %w", err)
+	}
+
+	// switch to the new root and detach the host filesystem
+	err = os.Mkdir(path.Join(root, ".oldroot"), 0o700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(root, path.Join(root, ".oldroot"))
+	if err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount("/.oldroot", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("detach old root: %w", err)
+	}
+	err = os.Remove("/.oldroot")
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("read-only root: %w", err)
+	}
+	return syscall.Sethostname([]byte("sandbox"))
+}
+
+// the sandbox's pid 1
+func sandboxInit() int {
+	var config sandboxConfig
+	if len(os.Args) < 2 {
+		return sandboxFail("init", errors.New("missing config"))
+	}
+	err := json.Unmarshal([]byte(os.Args[1]), &config)
+	if err != nil {
+		return sandboxFail("init", err)
+	}
+
+	// the program mustn't inherit the report pipe, or it could report whatever it likes
+	syscall.CloseOnExec(int(sandboxReportFd))
+
+	self, err := os.Executable()
+	if err != nil {
+		return sandboxFail("init", err)
+	}
+	err = setupSandboxFs(config, self)
+	if err != nil {
+		return sandboxFail("init", err)
+	}
+
+	limits, err := json.Marshal(config.Limits)
+	if err != nil {
+		return sandboxFail("init", err)
+	}
+
+	// the program runs in its own process group so that signals reach all of its processes.
+	// On a terminal it gets its own session instead, with the terminal as its controlling
+	// terminal, so that ^C and job control work like they do locally
+	args := append([]string{sandboxExecName, string(limits)}, config.Command...)
+	attr := os.ProcAttr{
+		Dir: "/source",
+		Env: append([]string{
+			"PATH=/usr/local/bin:/usr/bin:/bin",
+			"HOME=/tmp",
+			"TMPDIR=/tmp",
+			"LANG=C.UTF-8",
+		}, config.Env...),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys: &syscall.SysProcAttr{
+			Setpgid:    config.PTY == false,
+			Setsid:     config.PTY,
+			Setctty:    config.PTY,
+			Credential: &syscall.Credential{Uid: uint32(sandboxUID), Gid: uint32(sandboxGID), NoSetGroups: true},
+		},
+	}
+	child, err := os.StartProcess(sandboxInitPath, args, &attr)
+	if err != nil {
+		return sandboxFail("init", err)
+	}
+	// we don't need to run ourselves again, so hide the binary
+	_ = syscall.Unmount(sandboxInitPath, syscall.MNT_DETACH)
+
+	forwardSignals(child.Pid)
+
+	// as pid 1 we inherit every orphaned process, so reap everything until the program exits.
+	// Orphans' usage isn't counted in the program's, so add up everything we reap
+	var usage Usage
+	for {
+		var status syscall.WaitStatus
+		var rusage syscall.Rusage
+		pid, err := syscall.Wait4(-1, &status, 0, &rusage)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return sandboxFail("wait", err)
+		}
+		usage.CPUTime += time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+		// in KiB
+		usage.PeakMemory = max(usage.PeakMemory, rusage.Maxrss<<10)
+		if pid != child.Pid {
+			continue
+		}
+
+		// everything else in the sandbox dies with us
+		if status.Signaled() {
+			reportExit(sandboxReport{Usage: usage, Signal: status.Signal()})
+			return 128 + int(status.Signal())
+		}
+		reportExit(sandboxReport{Usage: usage})
+		return status.ExitStatus()
+	}
+}
+
+// tell the server how the program went. It's only for reporting, so errors are ignored
+func reportExit(report sandboxReport) {
+	f := os.NewFile(sandboxReportFd, "report")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(report)
+}
+
+// pass signals sent to the sandbox on to the program's process group
+func forwardSignals(pgid int) {
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			syscall.Kill(-pgid, sig.(syscall.Signal))
+		}
+	}()
+}
+
+// sandbox exec
+// =====================================
+
+const (
+	prSetNoNewPrivs        = 38
+	prCapAmbient           = 47
+	prCapAmbientClearAll   = 4
+	rlimitNproc            = 6
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+)
+
+// apply limits, privilege drops and the syscall filter, then replace ourselves with the program
+func sandboxExec() int {
+	if len(os.Args) < 3 {
+		return sandboxFail("exec", errors.New("missing command"))
+	}
+	var limits sandboxLimits
+	err := json.Unmarshal([]byte(os.Args[1]), &limits)
+	if err != nil {
+		return sandboxFail("exec", err)
+	}
+	command := os.Args[2:]
+
+	// without ambient capabilities, exec drops every capability since we aren't root.
+	// we only have any when the server wasn't root, see sandboxSysProcAttr
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0)
+	if errno != 0 {
+		return sandboxFail("drop capabilities", errno)
+	}
+
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, limits.CPUSeconds},
+		{syscall.RLIMIT_AS, limits.MemoryBytes},
+		{rlimitNproc, limits.Processes},
+		{syscall.RLIMIT_FSIZE, limits.FileBytes},
+		{syscall.RLIMIT_NOFILE, limits.OpenFiles},
+	}
+	for _, v := range rlimits {
+		if v.value == 0 {
+			continue
+		}
+		max := v.value
+		// going over the soft CPU limit sends SIGXCPU, which is how we tell that the program
+		// hit it. The hard limit only SIGKILLs programs that ignore that
+		if v.resource == syscall.RLIMIT_CPU {
+			max++
+		}
+		err = syscall.Setrlimit(v.resource, &syscall.Rlimit{Cur: v.value, Max: max})
+		if err != nil {
+			return sandboxFail("rlimit", err)
+		}
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 0, Max: 0})
+	if err != nil {
+		return sandboxFail("rlimit", err)
+	}
+
+	_, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0)
+	if errno != 0 {
+		return sandboxFail("no_new_privs", errno)
+	}
+	err = installSeccompFilter()
+	if err != nil {
+		return sandboxFail("seccomp", err)
+	}
+
+	prog, err := exec.LookPath(command[0])
+	if err != nil {
+		return sandboxFail("exec", err)
+	}
+	err = syscall.Exec(prog, command, os.Environ())
+	return sandboxFail("exec", err)
+}
+
+// seccomp
+// =====================================
+
+// a classic BPF instruction (struct sock_filter)
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+// struct sock_fprog
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+const (
+	bpfLdWAbs   = 0x00 | 0x00 | 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK     = 0x05 | 0x10 | 0x00 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK     = 0x05 | 0x30 | 0x00 // BPF_JMP | BPF_JGE | BPF_K
+	bpfJsetK    = 0x05 | 0x40 | 0x00 // BPF_JMP | BPF_JSET | BPF_K
+	bpfRetK     = 0x06 | 0x00        // BPF_RET | BPF_K
+	seccompNr   = 0                  // offsetof(struct seccomp_data, nr)
+	seccompArch = 4                  // offsetof(struct seccomp_data, arch)
+	seccompA0   = 16                 // offsetof(struct seccomp_data, args[0]), low half on little endian
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// clone flags that would create new namespaces
+	cloneNamespaceFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC |
+		syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | 0x02000000 // CLONE_NEWCGROUP
+)
+
+// build the sandbox's seccomp program. It kills programs using a foreign syscall ABI,
+// fails the syscalls in deniedSyscalls with EPERM and stops clone from creating namespaces
+func seccompFilter() []sockFilter {
+	eperm := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	filter := []sockFilter{
+		{bpfLdWAbs, 0, 0, seccompArch},
+		{bpfJeqK, 1, 0, auditArch},
+		{bpfRetK, 0, 0, seccompRetKillProcess},
+		{bpfLdWAbs, 0, 0, seccompNr},
+	}
+	if x32SyscallBit != 0 {
+		filter = append(filter,
+			sockFilter{bpfJgeK, 0, 1, x32SyscallBit},
+			sockFilter{bpfRetK, 0, 0, eperm},
+		)
+	}
+	for _, v := range deniedSyscalls {
+		filter = append(filter,
+			sockFilter{bpfJeqK, 0, 1, v},
+			sockFilter{bpfRetK, 0, 0, eperm},
+		)
+	}
+	filter = append(filter,
+		// make libc fall back from clone3 to clone, whose flags we can inspect
+		sockFilter{bpfJeqK, 0, 1, sysClone3},
+		sockFilter{bpfRetK, 0, 0, seccompRetErrno | uint32(syscall.ENOSYS)},
+		sockFilter{bpfJeqK, 0, 3, sysClone},
+		sockFilter{bpfLdWAbs, 0, 0, seccompA0},
+		sockFilter{bpfJsetK, 0, 1, cloneNamespaceFlags},
+		sockFilter{bpfRetK, 0, 0, eperm},
+		sockFilter{bpfRetK, 0, 0, seccompRetAllow},
+	)
+	return filter
+}
+
+// install the seccomp filter on every thread of this process
+func installSeccompFilter() error {
+	filter := seccompFilter()
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
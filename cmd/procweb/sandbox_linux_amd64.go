@@ -0,0 +1,56 @@
+package procweb
+
+// seccomp details for x86_64
+
+const (
+	auditArch  uint32  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp uintptr = 317
+	sysClone   uint32  = 56
+	sysClone3  uint32  = 435
+
+	// syscall numbers at or above this belong to the x32 ABI
+	x32SyscallBit uint32 = 0x40000000
+)
+
+// syscalls that sandboxed programs are never allowed to make
+var deniedSyscalls = []uint32{
+	165, // mount
+	166, // umount2
+	155, // pivot_root
+	161, // chroot
+	101, // ptrace
+	246, // kexec_load
+	320, // kexec_file_load
+	169, // reboot
+	167, // swapon
+	168, // swapoff
+	175, // init_module
+	313, // finit_module
+	176, // delete_module
+	272, // unshare
+	308, // setns
+	250, // keyctl
+	248, // add_key
+	249, // request_key
+	163, // acct
+	164, // settimeofday
+	227, // clock_settime
+	159, // adjtimex
+	179, // quotactl
+	103, // syslog
+	298, // perf_event_open
+	310, // process_vm_readv
+	311, // process_vm_writev
+	303, // name_to_handle_at
+	304, // open_by_handle_at
+	321, // bpf
+	323, // userfaultfd
+	172, // iopl
+	173, // ioperm
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	431, // fsconfig
+	432, // fsmount
+	442, // mount_setattr
+}
@@ -0,0 +1,54 @@
+package procweb
+
+// seccomp details for aarch64
+
+const (
+	auditArch  uint32  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp uintptr = 277
+	sysClone   uint32  = 220
+	sysClone3  uint32  = 435
+
+	// arm64 has no second syscall ABI, so no syscall number can have this bit
+	x32SyscallBit uint32 = 0
+)
+
+// syscalls that sandboxed programs are never allowed to make
+var deniedSyscalls = []uint32{
+	40,  // mount
+	39,  // umount2
+	41,  // pivot_root
+	51,  // chroot
+	117, // ptrace
+	104, // kexec_load
+	294, // kexec_file_load
+	142, // reboot
+	224, // swapon
+	225, // swapoff
+	105, // init_module
+	273, // finit_module
+	106, // delete_module
+	97,  // unshare
+	268, // setns
+	219, // keyctl
+	217, // add_key
+	218, // request_key
+	89,  // acct
+	170, // settimeofday
+	112, // clock_settime
+	171, // adjtimex
+	60,  // quotactl
+	116, // syslog
+	241, // perf_event_open
+	270, // process_vm_readv
+	271, // process_vm_writev
+	264, // name_to_handle_at
+	265, // open_by_handle_at
+	280, // bpf
+	282, // userfaultfd
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	431, // fsconfig
+	432, // fsmount
+	442, // mount_setattr
+}
@@ -0,0 +1,353 @@
+//go:build linux && (amd64 || arm64)
+
+package procweb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// run a shell script in the sandbox, returning its stdout and stderr
+func runInSandbox(t *testing.T, script string, stdin string) (string, string, error) {
+	return runInSandboxWithLimits(t, script, stdin, Limits{})
+}
+
+func runInSandboxWithLimits(t *testing.T, script string, stdin string, limits Limits) (string, string, error) {
+	stdout, stderr, _, err := runSandboxJob(t, script, stdin, limits, false)
+	return stdout, stderr, err
+}
+
+// run a shell script in the sandbox, returning its output and what it used
+func runSandboxJob(t *testing.T, script string, stdin string, limits Limits, pty bool) (string, string, Usage, error) {
+	dir, err := os.MkdirTemp("", "source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.WriteFile(path.Join(dir, "main.sh"), []byte(script), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := Job{
+		Dir:      dir,
+		Language: Language{Name: "sh", FileName: "main.sh", Run: []string{"sh", "main.sh"}},
+		Limits:   limits,
+		PTY:      pty,
+		Stdin:    make(chan []byte, 8),
+		Stdout:   make(chan ProcMessage, 8),
+		Stderr:   make(chan ProcMessage, 8),
+	}
+	job.Stdin <- []byte(stdin)
+	close(job.Stdin)
+
+	var stdout, stderr strings.Builder
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for msg := range job.Stderr {
+			stderr.WriteString(msg.Body)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for msg := range job.Stdout {
+			stdout.WriteString(msg.Body)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = SandboxRunner{}.Run(ctx, cancel, &job)
+	wg.Wait()
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skip("user namespaces aren't available:", err)
+	}
+	return stdout.String(), stderr.String(), job.Usage, err
+}
+
+func TestSandboxRunner(t *testing.T) {
+	script := `echo hi
+touch /usr/sandbox-test 2>/dev/null && echo writable root
+echo lost > /dev/null || echo no /dev/null
+echo ok > /source/out && cat /source/out
+id -u
+cat
+`
+	stdout, stderr, err := runInSandbox(t, script, "from stdin\n")
+	if err != nil {
+		t.Fatal(err, stderr)
+	}
+	want := "hi\nok\n65534\nfrom stdin\n"
+	if stdout != want {
+		t.Errorf("stdout: want %q, got %q (stderr %q)", want, stdout, stderr)
+	}
+}
+
+func TestSandboxSeccomp(t *testing.T) {
+	// nested namespaces are blocked by the seccomp filter
+	stdout, _, err := runInSandbox(t, "unshare -U true 2>/dev/null || echo blocked", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "blocked\n" {
+		t.Errorf("unshare wasn't blocked: %q", stdout)
+	}
+}
+
+func TestSandboxCPULimit(t *testing.T) {
+	limits := Limits{CPUTime: time.Second}
+	_, _, usage, err := runSandboxJob(t, "while :; do :; done", "", limits, false)
+	if limit := exitLimit(err, limits, usage); limit == nil || limit.Kind != LimitKindCPU {
+		t.Errorf("expected the CPU limit to stop the program, got %v (%+v)", err, limit)
+	}
+	// a program that ignores SIGXCPU is killed at the hard limit
+	_, _, usage, err = runSandboxJob(t, "trap '' XCPU\nwhile :; do :; done", "", limits, false)
+	if limit := exitLimit(err, limits, usage); limit == nil || limit.Reason != "CPU time limit exceeded (1s)" {
+		t.Errorf("expected the CPU limit to kill the program, got %v (%+v)", err, limit)
+	}
+}
+
+// RLIMIT_AS makes allocations fail, which programs die of in their own ways
+func TestSandboxMemoryLimit(t *testing.T) {
+	limits := Limits{Memory: 64 << 20}
+	_, stderr, usage, err := runSandboxJob(t, "command -v python3 >/dev/null || exit 99\npython3 -c 'a = []\nwhile True: a.append(\" \" * 1000000)'", "", limits, false)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 99 {
+		t.Skip("python3 isn't installed")
+	}
+	if limit := exitLimit(err, limits, usage); limit == nil || limit.Kind != LimitKindMemory || limit.Reason != "memory limit exceeded (64 MiB)" {
+		t.Errorf("expected the memory limit to stop the program, got %v (%+v, %s)", err, limit, stderr)
+	}
+
+	// failing without using much memory isn't the limit
+	_, _, usage, err = runSandboxJob(t, "exit 1", "", limits, false)
+	if limit := exitLimit(err, limits, usage); limit != nil {
+		t.Errorf("a failing program was put down to %q", limit.Reason)
+	}
+}
+
+// exiting with 128+signal, or a program killing itself, isn't a limit
+func TestSandboxNotALimit(t *testing.T) {
+	limits := Limits{CPUTime: 10 * time.Second, Memory: 64 << 20}
+	_, _, usage, err := runSandboxJob(t, "exit 137", "", limits, false)
+	if sig, ok := exitSignal(err); ok || exitLimit(err, limits, usage) != nil {
+		t.Errorf("exit 137 was taken for a signal: %v (%s)", err, sig)
+	}
+	_, _, usage, err = runSandboxJob(t, "kill -9 $$", "", limits, false)
+	if sig, ok := exitSignal(err); ok == false || sig != syscall.SIGKILL {
+		t.Errorf("expected SIGKILL, got %v", err)
+	}
+	if limit := exitLimit(err, limits, usage); limit != nil {
+		t.Errorf("a program killing itself was put down to %q", limit.Reason)
+	}
+}
+
+// the sandbox only sees the host's /etc files that programs need
+func TestSandboxEtc(t *testing.T) {
+	stdout, stderr, err := runInSandbox(t, "ls /etc\ncat /etc/passwd\nid -un", "")
+	if err != nil {
+		t.Fatal(err, stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	for _, v := range lines {
+		if strings.Contains(v, ":") || v == "nobody" {
+			continue
+		}
+		if slices.Contains([]string{"alternatives", "group", "ld.so.cache", "localtime", "passwd"}, v) == false {
+			t.Errorf("host file /etc/%s is in the sandbox", v)
+		}
+	}
+	if slices.Contains(lines, "nobody") == false {
+		t.Errorf("the sandbox user has no name: %q", stdout)
+	}
+}
+
+// with a root server, running sandboxes don't share a host user, or RLIMIT_NPROC would be shared too
+func TestSandboxHostIDs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only a root server can give sandboxes their own users")
+	}
+	uid1, _, release1, err := sandboxHostIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid2, _, release2, err := sandboxHostIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid1 == uid2 || uid1 == 0 || uid2 == 0 {
+		t.Errorf("bad sandbox users %d and %d", uid1, uid2)
+	}
+	release1()
+	release2()
+}
+
+func TestSandboxUsage(t *testing.T) {
+	// a busy loop in an orphan, which the sandbox init has to reap, and in the program
+	script := `sh -c 'i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done' &
+i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done
+wait
+`
+	_, stderr, usage, err := runSandboxJob(t, script, "", Limits{}, false)
+	if err != nil {
+		t.Fatal(err, stderr)
+	}
+	if usage.CPUTime <= 0 || usage.CPUTime > 10*time.Second {
+		t.Errorf("bad CPU time %s", usage.CPUTime)
+	}
+	// more than nothing, but not the server's own memory
+	if usage.PeakMemory < 64<<10 || usage.PeakMemory > 64<<20 {
+		t.Errorf("bad peak memory %d", usage.PeakMemory)
+	}
+
+	// the program can't write its own usage report
+	_, stderr, usage, err = runSandboxJob(t, `echo '{"CPUTime": 1}' >&3`, "", Limits{}, false)
+	if err == nil || usage.CPUTime == 1 {
+		t.Errorf("the program could write to the usage pipe: %v %+v", err, usage)
+	}
+}
+
+func TestSandboxPTY(t *testing.T) {
+	script := `[ -t 0 ] && [ -t 1 ] && echo tty
+read line
+echo "got $line"
+stty size
+`
+	stdout, stderr, _, err := runSandboxJob(t, script, "hello\n", Limits{}, true)
+	if err != nil {
+		t.Fatal(err, stdout)
+	}
+	if stderr != "" {
+		t.Errorf("a terminal has no separate stderr, got %q", stderr)
+	}
+	// the terminal echoes input and translates newlines, and the echo can come at any point
+	for _, want := range []string{"tty\r\n", "hello\r\n", "got hello\r\n", "24 80\r\n"} {
+		if strings.Contains(stdout, want) == false {
+			t.Errorf("expected %q in the output, got %q", want, stdout)
+		}
+	}
+}
+
+func TestSandboxPTYResize(t *testing.T) {
+	dir := t.TempDir()
+	script := `stty size
+trap 'stty size; exit 0' WINCH
+echo ready
+while :; do sleep 0.05; done
+`
+	err := os.WriteFile(path.Join(dir, "main.sh"), []byte(script), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := Job{
+		Dir:      dir,
+		Language: Language{Name: "sh", FileName: "main.sh", Run: []string{"sh", "main.sh"}},
+		PTY:      true,
+		Size:     TermSize{Rows: 30, Cols: 100},
+		Resize:   make(chan TermSize, 1),
+		Stdin:    make(chan []byte, 8),
+		Stdout:   make(chan ProcMessage, 8),
+		Stderr:   make(chan ProcMessage, 8),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- SandboxRunner{}.Run(ctx, cancel, &job)
+	}()
+
+	// resize once the program is ready for it
+	var stdout strings.Builder
+	resized := false
+	for msg := range job.Stdout {
+		stdout.WriteString(msg.Body)
+		if strings.Contains(stdout.String(), "ready") && resized == false {
+			job.Resize <- TermSize{Rows: 40, Cols: 120}
+			resized = true
+		}
+	}
+	err = <-errChan
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skip("user namespaces aren't available:", err)
+	}
+	if err != nil {
+		t.Fatal(err, stdout.String())
+	}
+	want := "30 100\r\nready\r\n40 120\r\n"
+	if stdout.String() != want {
+		t.Errorf("want %q, got %q", want, stdout.String())
+	}
+}
+
+// run a script in the sandbox, sending it sig once it prints ready
+func signalSandbox(t *testing.T, script string, sig syscall.Signal) (string, error) {
+	dir := t.TempDir()
+	err := os.WriteFile(path.Join(dir, "main.sh"), []byte(script), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := Job{
+		Dir:      dir,
+		Language: Language{Name: "sh", FileName: "main.sh", Run: []string{"sh", "main.sh"}},
+		Signals:  make(chan syscall.Signal, 1),
+		Stdin:    make(chan []byte, 8),
+		Stdout:   make(chan ProcMessage, 8),
+		Stderr:   make(chan ProcMessage, 8),
+	}
+	go func() {
+		for range job.Stderr {
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- SandboxRunner{}.Run(ctx, cancel, &job)
+	}()
+
+	var stdout strings.Builder
+	signalled := false
+	for msg := range job.Stdout {
+		stdout.WriteString(msg.Body)
+		if strings.Contains(stdout.String(), "ready") && signalled == false {
+			job.Signals <- sig
+			signalled = true
+		}
+	}
+	err = <-errChan
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skip("user namespaces aren't available:", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the signal didn't stop the program")
+	}
+	return stdout.String(), err
+}
+
+func TestSandboxSignal(t *testing.T) {
+	stdout, err := signalSandbox(t, "trap 'echo caught; exit 3' INT\necho ready\nwhile :; do sleep 0.05; done\n", syscall.SIGINT)
+	if stdout != "ready\ncaught\n" {
+		t.Errorf("expected the program to handle the signal, got %q", stdout)
+	}
+	if got := describeExit(err, false, ""); got != "exited with status 3" {
+		t.Errorf("expected the handler's exit status, got %q", got)
+	}
+
+	_, err = signalSandbox(t, "echo ready\nwhile :; do :; done\n", syscall.SIGTERM)
+	if got := describeExit(err, false, ""); got != "terminated by SIGTERM" {
+		t.Errorf("expected the program to be terminated, got %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux || !(amd64 || arm64)
+
+package procweb
+
+import (
+	"context"
+	"errors"
+)
+
+// SandboxRunner needs linux namespaces and a seccomp filter for this architecture,
+// so it can't run programs here
+type SandboxRunner struct {
+	Mounts    []string
+	FileBytes uint64
+	OpenFiles uint64
+}
+
+func (r SandboxRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	return abortJob(cancel, job, errors.New("the sandbox runner is only supported on linux/amd64 and linux/arm64"))
+}
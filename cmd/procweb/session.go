@@ -0,0 +1,581 @@
+package procweb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessions
+// =====================================
+
+// how long a program waits for its client to come back after the connection drops
+const DefaultResumeGrace = 30 * time.Second
+
+// how much recent output a session keeps for clients that come back, in bytes
+const DefaultReplayBytes = 256 << 10
+
+// how many messages can wait for a session's owner before the program waits for it
+const ownerBacklog = 8
+
+// a SessionStore keeps the sessions that clients can come back to, by resume token
+type SessionStore struct {
+	// how long a session waits for its client to come back. Zero means DefaultResumeGrace
+	Grace time.Duration
+	// how much output is kept for the client to catch up on. Zero means DefaultReplayBytes
+	ReplayBytes int
+
+	mtx      sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session)}
+}
+
+func (s *SessionStore) grace() time.Duration {
+	if s.Grace == 0 {
+		return DefaultResumeGrace
+	}
+	return s.Grace
+}
+
+func (s *SessionStore) replayBytes() int {
+	if s.ReplayBytes == 0 {
+		return DefaultReplayBytes
+	}
+	return s.ReplayBytes
+}
+
+func (s *SessionStore) get(token string) *Session {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sessions[token]
+}
+
+func (s *SessionStore) add(session *Session) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sessions[session.token] = session
+}
+
+func (s *SessionStore) remove(token string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.sessions, token)
+}
+
+// a Session is an instance's running program, along with the connections that come and go
+// while it runs. Everything the program sends is numbered once, for the whole session, so
+// a client that comes back can say where it got up to
+type Session struct {
+	// the instance's ID, which stays the same across connections
+	id string
+	// what the client comes back with, "" if it can't
+	token string
+	store *SessionStore
+	// what other clients join with, "" if they can't
+	watchToken string
+	pairToken  string
+	hub        *Hub
+	run        *Run
+	// the run's logger, which has the instance's ID
+	log     *slog.Logger
+	started time.Time
+
+	// how messages are shaped for the client that started the session
+	queueUpdates    bool
+	truncateNotices bool
+
+	// guards everything below. It's held while messages are numbered and queued, so they go
+	// out in order
+	mtx sync.Mutex
+	// signalled when the owner takes its pending messages, for the program to wait on
+	drained  *sync.Cond
+	seq      uint64
+	lastTime int64
+	// the most recent messages, oldest first
+	replay     []ProcMessage
+	replaySize int
+	conn       *sessionConn
+	viewers    map[*sessionConn]bool
+	pumping    sync.Once
+	graceTimer *time.Timer
+	done       bool
+	// how much of the program's output has been sent on
+	outputBytes int64
+	stdinMtx    sync.Mutex
+	stdinClosed bool
+	// how much input the program's been given, guarded by stdinMtx
+	inputBytes int64
+}
+
+// one of a session's connections
+type sessionConn struct {
+	ws *websocket.Conn
+	// lasts as long as the connection
+	ctx context.Context
+	// the sender's channel. The session closes it to close the connection
+	out chan ProcMessage
+	// whether the client decodes base64 output
+	base64Output bool
+	// ViewerWatch or ViewerPair for viewers that joined, "" for the client that owns the session
+	mode string
+	// the owner's messages waiting to go on its channel, oldest first, guarded by the
+	// session's lock. forward sends them, so the lock isn't held while waiting on the client
+	pending []ProcMessage
+	// whether the channel is closed once pending has been sent
+	ending bool
+	// pokes forward when there's more to send
+	wake chan struct{}
+}
+
+// a new session for run, whose messages are numbered on from seq. Output starts flowing
+// once the first client is served, so none of it goes missing
+func newSession(id string, run *Run, seq uint64) *Session {
+	s := &Session{id: id, run: run, log: run.log, started: time.Now(), seq: seq, viewers: make(map[*sessionConn]bool)}
+	s.drained = sync.NewCond(&s.mtx)
+	return s
+}
+
+// let the client come back to the session with token
+func (s *Session) resumeWith(store *SessionStore, token string) {
+	s.store = store
+	s.token = token
+	store.add(s)
+}
+
+// let other clients join the session, to watch it with watch or to pair on it with pair
+func (s *Session) shareWith(hub *Hub, watch string, pair string) {
+	s.hub = hub
+	s.watchToken = watch
+	s.pairToken = pair
+	hub.add(s)
+}
+
+// how much output is kept for clients that come back or join late, 0 for none
+func (s *Session) replayBytes() int {
+	if s.store != nil {
+		return s.store.replayBytes()
+	}
+	if s.hub != nil {
+		return DefaultReplayBytes
+	}
+	return 0
+}
+
+// pass the program's output on to the session's client, shaped for what it understands
+func (s *Session) pump() {
+	for msg := range s.run.Output {
+		if msg.Category == "queued" && s.queueUpdates == false {
+			continue
+		}
+		if msg.Category == "truncated" && s.truncateNotices == false {
+			msg = ProcMessage{Category: "stderr", Body: "\n" + msg.Body + "\n", Time: msg.Time}
+		}
+		s.send(msg)
+	}
+	s.finish()
+}
+
+// number msg, keep it in case a client has to catch up, and send it to every client that's
+// connected. Nothing is sent after the exit status
+func (s *Session) send(msg ProcMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.deliver(msg)
+	// the program waits for its owner, but not for anyone watching. Waiting lets go of the
+	// lock, so the session carries on around it
+	for s.conn != nil && len(s.conn.pending) >= ownerBacklog && s.conn.ctx.Err() == nil {
+		s.drained.Wait()
+	}
+}
+
+// send, for when the session's lock is already held
+func (s *Session) deliver(msg ProcMessage) {
+	if s.done {
+		return
+	}
+	s.seq++
+	msg.Seq = s.seq
+	// messages that weren't captured from the program are timestamped here, and times are
+	// kept from going backwards, which two outputs racing each other could make them do
+	if msg.Time == 0 {
+		msg.Time = captureTime()
+	}
+	msg.Time = max(msg.Time, s.lastTime)
+	s.lastTime = msg.Time
+	if msg.Category == "stdout" || msg.Category == "stderr" {
+		s.outputBytes += int64(len(msg.Body))
+	}
+
+	if limit := s.replayBytes(); limit != 0 {
+		s.replay = append(s.replay, msg)
+		s.replaySize += len(msg.Body)
+		for s.replaySize > limit && len(s.replay) > 1 {
+			s.replaySize -= len(s.replay[0].Body)
+			s.replay = s.replay[1:]
+		}
+	}
+	if s.conn != nil {
+		s.conn.queue(msg)
+	}
+	dropped := false
+	for viewer := range s.viewers {
+		if viewer.offer(msg) == false {
+			s.drop(viewer)
+			dropped = true
+		}
+	}
+	if msg.Category == "exit" {
+		s.done = true
+	}
+	if dropped {
+		s.deliver(s.viewersMessage())
+	}
+}
+
+// let go of a viewer that fell behind or went away, for when the session's lock is held
+func (s *Session) drop(viewer *sessionConn) {
+	s.log.Info("dropping a viewer that fell behind", "mode", viewer.mode)
+	close(viewer.out)
+	delete(s.viewers, viewer)
+}
+
+// add msg to what's waiting for the owner, for when the session's lock is held
+func (c *sessionConn) queue(msg ProcMessage) {
+	// binary frames carry output as it is
+	if c.base64Output && framed(c.ws) == false {
+		msg = encodeOutput(msg)
+	}
+	c.pending = append(c.pending, msg)
+	c.poke()
+}
+
+// close the owner's channel once everything queued has been sent, for when the session's
+// lock is held
+func (c *sessionConn) end() {
+	c.ending = true
+	c.poke()
+}
+
+func (c *sessionConn) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pass what's queued for the owner on to its channel, until the channel's ended or the
+// connection's gone
+func (s *Session) forward(c *sessionConn) {
+	defer func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.drained.Broadcast()
+	}()
+	for {
+		s.mtx.Lock()
+		msgs, ending := c.pending, c.ending
+		c.pending = nil
+		s.drained.Broadcast()
+		s.mtx.Unlock()
+
+		for _, msg := range msgs {
+			select {
+			case <-c.ctx.Done():
+				return
+			case c.out <- msg:
+			}
+		}
+		if ending {
+			close(c.out)
+			return
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.wake:
+		}
+	}
+}
+
+// send msg to a viewer without waiting for it, since it's sent with the session's lock held.
+// A viewer whose backlog is full is told it fell behind instead, and false is returned so
+// the session can let it go, as it is for a viewer whose connection is gone
+func (c *sessionConn) offer(msg ProcMessage) bool {
+	// everything sent to viewers goes through here under the session's lock, so the last
+	// slot is free for the error
+	if len(c.out) >= cap(c.out)-1 {
+		select {
+		case c.out <- errorMessage(protocolErrorf(ErrTooSlow, "fell more than %d messages behind", cap(c.out)-1)):
+		default:
+		}
+		return false
+	}
+	if c.base64Output && framed(c.ws) == false {
+		msg = encodeOutput(msg)
+	}
+	select {
+	case <-c.ctx.Done():
+		return false
+	case c.out <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// the program is done and everything it sent has been sent on. Close the client's
+// connection, and forget the session once the client has had time to come back for the end
+func (s *Session) finish() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.done = true
+	if s.conn != nil {
+		s.conn.end()
+		s.conn = nil
+	}
+	for viewer := range s.viewers {
+		close(viewer.out)
+		delete(s.viewers, viewer)
+	}
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+	}
+	if s.hub != nil {
+		s.hub.remove(s.watchToken, s.pairToken)
+	}
+	if s.store != nil {
+		time.AfterFunc(s.store.grace(), func() {
+			s.store.remove(s.token)
+		})
+	}
+	s.stdinMtx.Lock()
+	inputBytes := s.inputBytes
+	s.stdinMtx.Unlock()
+	s.log.Info("instance done",
+		"duration", time.Since(s.started),
+		"input_bytes", inputBytes,
+		"output_bytes", s.outputBytes,
+	)
+}
+
+// make conn the session's connection, after catching it up on everything after lastSeq.
+// A connection the client left behind is closed
+func (s *Session) attach(conn *sessionConn, lastSeq uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+	if s.conn != nil {
+		s.conn.end()
+	}
+
+	if len(s.replay) != 0 && s.replay[0].Seq > lastSeq+1 {
+		conn.queue(errorMessage(protocolErrorf(ErrReplayGap, "messages %d to %d are gone, catching up from %d", lastSeq+1, s.replay[0].Seq-1, s.replay[0].Seq)))
+	}
+	for _, msg := range s.replay {
+		if msg.Seq > lastSeq {
+			conn.queue(msg)
+		}
+	}
+
+	if s.done {
+		// the client's caught up on how the program ended, so there's nothing more to say
+		conn.end()
+		s.conn = nil
+		return
+	}
+	s.conn = conn
+}
+
+// add a viewer to the session, after showing it the output that's been kept. The viewer's
+// channel is made here, with room for that output as well as its backlog
+func (s *Session) join(conn *sessionConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// and room for telling the viewer it fell behind
+	conn.out = make(chan ProcMessage, len(s.replay)+s.hub.backlog()+1)
+	for _, msg := range s.replay {
+		conn.offer(msg)
+	}
+	if s.done {
+		close(conn.out)
+		return
+	}
+	s.viewers[conn] = true
+	s.log.Info("a viewer joined", "mode", conn.mode)
+	s.deliver(s.viewersMessage())
+}
+
+// the viewer's connection is gone
+func (s *Session) leave(conn *sessionConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.viewers[conn] == false {
+		return
+	}
+	delete(s.viewers, conn)
+	s.log.Info("a viewer left", "mode", conn.mode)
+	s.deliver(s.viewersMessage())
+}
+
+// the "viewers" message, which tells everyone how many viewers there are
+func (s *Session) viewersMessage() ProcMessage {
+	return ProcMessage{Category: "viewers", Body: fmt.Sprintf(`{"viewers": %d}`, len(s.viewers))}
+}
+
+// send msg to just the one connection, outside of the session's numbering. It's about the
+// connection, like an error in something its client sent, not the program
+func (s *Session) reply(conn *sessionConn, msg ProcMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.conn != conn && s.viewers[conn] == false {
+		return
+	}
+	msg.Time = captureTime()
+	if conn != s.conn {
+		if conn.offer(msg) == false {
+			s.drop(conn)
+			s.deliver(s.viewersMessage())
+		}
+		return
+	}
+	conn.queue(msg)
+}
+
+// the connection's gone. Give the client a while to come back before killing the program
+func (s *Session) detach(conn *sessionConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.conn != conn {
+		return
+	}
+	s.conn = nil
+	// the program isn't waiting on this connection any more
+	s.drained.Broadcast()
+	if s.done {
+		return
+	}
+	if s.store == nil {
+		s.log.Info("client left, killing the program")
+		s.run.Signal(syscall.SIGKILL)
+		return
+	}
+	s.log.Info("client left, waiting for it to come back", "grace", s.store.grace())
+	s.graceTimer = time.AfterFunc(s.store.grace(), func() {
+		s.log.Info("client didn't come back, killing the program")
+		s.run.Signal(syscall.SIGKILL)
+	})
+}
+
+// talk to a client over ws until the connection closes. lastSeq is the last message the
+// client has already seen. mode is "" for the session's owner, or how a viewer joined
+func (s *Session) serve(ws *websocket.Conn, mtx *sync.Mutex, base64Output bool, lastSeq uint64, mode string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &sessionConn{ws: ws, ctx: ctx, base64Output: base64Output, mode: mode}
+
+	// scan our process I/O. The sender closes the socket when the session closes its channel
+	incomingMsgChan := ScanProcConnection(ctx, cancel, ws, mtx, s.log)
+	if mode == "" {
+		conn.out = make(chan ProcMessage, 8)
+		conn.wake = make(chan struct{}, 1)
+		SendProcConnection(ctx, cancel, ws, mtx, s.log, conn.out, "output")
+		go s.forward(conn)
+		s.attach(conn, lastSeq)
+		defer s.detach(conn)
+	} else {
+		// the sender starts after the replay is queued, which doesn't wait for it
+		s.join(conn)
+		SendProcConnection(ctx, cancel, ws, mtx, s.log, conn.out, "viewer")
+		defer s.leave(conn)
+	}
+	s.pumping.Do(func() {
+		go s.pump()
+	})
+
+	// tell the client what it did wrong
+	reject := func(err *ProtocolError) {
+		s.log.Info("protocol error", "err", err, "mode", conn.mode)
+		s.reply(conn, errorMessage(err))
+	}
+	// consume the incoming messages and pass new messages to the right places
+	// for example, forward the body of stdin messages to the program's stdin
+	for msg := range incomingMsgChan {
+		select {
+		case <-s.run.Finished():
+			// nothing's listening any more, but keep reading until the client goes
+			continue
+		default:
+		}
+
+		if mode == ViewerWatch && slices.Contains([]string{"stdin", "EOF", "signal"}, msg.Category) {
+			reject(protocolErrorf(ErrReadOnly, "%s from a viewer that can only watch", msg.Category))
+			continue
+		}
+		switch msg.Category {
+		case "stdin":
+			s.stdin(ctx, msg.Body)
+		case "EOF":
+			if msg.Body == "stdin" {
+				s.closeStdin()
+			}
+		case "resize":
+			size, err := parseTermSize(msg.Body)
+			if err != nil {
+				reject(protocolErrorf(ErrBadMessage, "%s", err))
+				continue
+			}
+			// the owner's terminal decides the size
+			if mode == "" {
+				s.run.Resize(size)
+			}
+		case "signal":
+			sig, err := parseSignal(msg.Body)
+			if err != nil {
+				reject(protocolErrorf(ErrBadMessage, "%s", err))
+				continue
+			}
+			s.run.Signal(sig)
+		case "hello", "code", "file", "entrypoint":
+			reject(protocolErrorf(ErrUnexpectedMessage, "%s after the program started", msg.Category))
+		default:
+			reject(protocolErrorf(ErrUnknownCategory, "unknown message category %q", msg.Category))
+		}
+	}
+}
+
+// pass input on to the program, unless its input has ended
+func (s *Session) stdin(ctx context.Context, body string) {
+	s.stdinMtx.Lock()
+	defer s.stdinMtx.Unlock()
+	if s.stdinClosed {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-s.run.Finished():
+	case s.run.Stdin <- []byte(body):
+		s.inputBytes += int64(len(body))
+	}
+}
+
+// end the program's input. Keep going, the terminal can still be resized
+func (s *Session) closeStdin() {
+	s.stdinMtx.Lock()
+	defer s.stdinMtx.Unlock()
+	if s.stdinClosed == false {
+		close(s.run.Stdin)
+		s.stdinClosed = true
+	}
+}
@@ -0,0 +1,241 @@
+package procweb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// say hello to a new instance, or one we're coming back to, and return its welcome
+func helloInstance(t *testing.T, ws *websocket.Conn, hello Hello) Welcome {
+	t.Helper()
+	body, _ := json.Marshal(hello)
+	err := writeProcMessage(ws, ProcMessage{Category: "hello", Body: string(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := readMessage(t, ws)
+	if msg.Category != "welcome" {
+		t.Fatalf("expected a welcome, got %+v", msg)
+	}
+	var welcome Welcome
+	err = json.Unmarshal([]byte(msg.Body), &welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return welcome
+}
+
+func readMessage(t *testing.T, ws *websocket.Conn) ProcMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readProcMessage(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// read everything until the instance closes the connection
+func readRest(t *testing.T, ws *websocket.Conn) []ProcMessage {
+	t.Helper()
+	var msgs []ProcMessage
+	for {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := readProcMessage(ws)
+		if err != nil {
+			if websocket.IsCloseError(err, 1000) == false {
+				t.Fatal(err)
+			}
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// start a program that can be resumed
+func startResumable(t *testing.T, store *SessionStore, program func(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error) (*websocket.Conn, Welcome) {
+	t.Helper()
+	config := InstanceConfig{Runner: FakeRunner{Program: program}, Language: Languages["luajit"], Sessions: store}
+	ourSock, instanceSock := createSockets()
+	go NewInstance(instanceSock, config)
+	welcome := helloInstance(t, ourSock, Hello{Version: 1, Features: []string{"exit", "seq", "resume"}})
+	if welcome.Resume == "" {
+		t.Fatalf("expected a resume token, got %+v", welcome)
+	}
+	writeProcMessage(ourSock, ProcMessage{Category: "EOF", Body: "code"})
+	return ourSock, welcome
+}
+
+func TestResume(t *testing.T) {
+	store := NewSessionStore()
+	ws, welcome := startResumable(t, store, fakeEchoLua)
+	writeProcMessage(ws, ProcMessage{Category: "stdin", Body: "one\n"})
+	if msg := readMessage(t, ws); msg.Body != "one\n" || msg.Seq != 2 {
+		t.Fatalf("bad output %+v", msg)
+	}
+	// the connection drops before we've taken in the output
+	ws.Close()
+
+	ws, instanceSock := createSockets()
+	go NewInstance(instanceSock, InstanceConfig{Language: Languages["luajit"], Sessions: store})
+	back := helloInstance(t, ws, Hello{Version: 1, Features: []string{"exit", "seq", "resume"}, Resume: welcome.Resume, LastSeq: 1})
+	if back.Instance != welcome.Instance || back.Resume != welcome.Resume {
+		t.Errorf("came back to %+v, expected %+v", back, welcome)
+	}
+	writeProcMessage(ws, ProcMessage{Category: "stdin", Body: "two\n"})
+	writeProcMessage(ws, ProcMessage{Category: "EOF", Body: "stdin"})
+	msgs := readRest(t, ws)
+
+	if stdout := combineCategory(msgs, "stdout").Body; stdout != "one\ntwo\n" {
+		t.Errorf("bad output after resuming %q", stdout)
+	}
+	// nothing's missing or sent twice
+	for i, msg := range msgs {
+		if msg.Seq != uint64(i+2) {
+			t.Errorf("expected message %d, got %+v", i+2, msg)
+		}
+	}
+	if exit := exitStatus(t, msgs); exit.Code != 0 {
+		t.Errorf("bad exit %+v", exit)
+	}
+}
+
+func TestResumeFailed(t *testing.T) {
+	ws, instanceSock := createSockets()
+	go NewInstance(instanceSock, InstanceConfig{Language: Languages["luajit"], Sessions: NewSessionStore()})
+	body, _ := json.Marshal(Hello{Version: 1, Resume: "nope"})
+	writeProcMessage(ws, ProcMessage{Category: "hello", Body: string(body)})
+	msgs := readRest(t, ws)
+	if len(msgs) != 1 || msgs[0].Category != "error" || protocolErrorCode(msgs[0]) != ErrResumeFailed {
+		t.Errorf("expected a resume_failed error, got %v", msgs)
+	}
+}
+
+func TestReplayGap(t *testing.T) {
+	store := NewSessionStore()
+	store.ReplayBytes = 4
+	ws, welcome := startResumable(t, store, fakeEchoLua)
+	for _, line := range []string{"aaaa\n", "bbbb\n"} {
+		writeProcMessage(ws, ProcMessage{Category: "stdin", Body: line})
+		readMessage(t, ws)
+	}
+	ws.Close()
+
+	ws, instanceSock := createSockets()
+	go NewInstance(instanceSock, InstanceConfig{Language: Languages["luajit"], Sessions: store})
+	helloInstance(t, ws, Hello{Version: 1, Resume: welcome.Resume, LastSeq: 1})
+	if msg := readMessage(t, ws); protocolErrorCode(msg) != ErrReplayGap {
+		t.Errorf("expected a replay_gap error, got %+v", msg)
+	}
+	// only the most recent output is left
+	if msg := readMessage(t, ws); msg.Body != "bbbb\n" || msg.Seq != 3 {
+		t.Errorf("bad replay %+v", msg)
+	}
+	writeProcMessage(ws, ProcMessage{Category: "EOF", Body: "stdin"})
+	exitStatus(t, readRest(t, ws))
+}
+
+func TestResumeGrace(t *testing.T) {
+	store := NewSessionStore()
+	store.Grace = 50 * time.Millisecond
+	ws, welcome := startResumable(t, store, fakeForever)
+	// the session starts once the program does
+	eventually(t, "the session never started", func() bool {
+		return store.get(welcome.Resume) != nil
+	})
+	session := store.get(welcome.Resume)
+	ws.Close()
+
+	// nobody comes back, so the program is killed and then forgotten
+	eventually(t, "the session was never forgotten", func() bool {
+		return store.get(welcome.Resume) == nil
+	})
+	if status := session.run.Status(); status.Signal != "SIGKILL" {
+		t.Errorf("bad exit %+v", status)
+	}
+}
+
+// wait a while for cond to hold, failing with msg if it doesn't
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for cond() == false {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// without a session store or a hub, clients aren't offered tokens that won't work
+func TestResumeNotOffered(t *testing.T) {
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeHelloLua}, Language: Languages["luajit"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1, "features": ["exit", "resume", "viewers"]}`},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var welcome Welcome
+	json.Unmarshal([]byte(msgs[0].Body), &welcome)
+	if welcome.Resume != "" || welcome.Watch != "" || len(welcome.Features) != 1 {
+		t.Errorf("tokens offered without sessions: %+v", welcome)
+	}
+}
+
+// coming back to a program doesn't count as running another one, so a client that's used
+// up its runs can still resume
+func TestResumeNotCharged(t *testing.T) {
+	store := NewSessionStore()
+	var runs atomic.Int32
+	allowRun := func() (bool, time.Duration) {
+		return runs.Add(1) == 1, 30 * time.Second
+	}
+	config := InstanceConfig{Runner: FakeRunner{Program: fakeEchoLua}, Language: Languages["luajit"], Sessions: store, AllowRun: allowRun}
+	ws, instanceSock := createSockets()
+	go NewInstance(instanceSock, config)
+	welcome := helloInstance(t, ws, Hello{Version: 1, Features: []string{"exit", "seq", "resume"}})
+	writeProcMessage(ws, ProcMessage{Category: "EOF", Body: "code"})
+	eventually(t, "the session never started", func() bool {
+		return store.get(welcome.Resume) != nil
+	})
+	ws.Close()
+
+	ws, instanceSock = createSockets()
+	go NewInstance(instanceSock, config)
+	helloInstance(t, ws, Hello{Version: 1, Features: []string{"exit", "seq", "resume"}, Resume: welcome.Resume})
+	writeProcMessage(ws, ProcMessage{Category: "EOF", Body: "stdin"})
+	if exit := exitStatus(t, readRest(t, ws)); exit.Code != 0 {
+		t.Errorf("bad exit after resuming %+v", exit)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("expected 1 run to be charged, got %d", n)
+	}
+
+	// but starting another one is turned away
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "hello", Body: `{"version": 1}`},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, []string{ErrRateLimited}) == false {
+		t.Errorf("expected a rate_limited error, got %v", msgs)
+	}
+}
+
+// the code of an error message
+func protocolErrorCode(msg ProcMessage) string {
+	var perr ProtocolError
+	json.Unmarshal([]byte(msg.Body), &perr)
+	return perr.Code
+}
@@ -0,0 +1,126 @@
+package procweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// program workspaces
+// =====================================
+
+// the most files a program can have
+const maxWorkspaceFiles = 64
+
+// the body of a "file" message. Several messages for the same path are appended to each
+// other, so big files can be sent in pieces
+type FileMessage struct {
+	// the file's path relative to the program's directory, like "player.lua" or "data/levels.txt"
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// a Workspace holds a program's files until it runs
+type Workspace struct {
+	files map[string]*bytes.Buffer
+	// the order the files were first sent in
+	order []string
+}
+
+func NewWorkspace() *Workspace {
+	return &Workspace{files: make(map[string]*bytes.Buffer)}
+}
+
+// check that a path stays inside the program's directory, and is written the one way we
+// accept it. Backslashes are rejected so that a path means the same thing everywhere
+func validateFilePath(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty file path")
+	}
+	if strings.ContainsAny(p, "\\\x00") || path.Clean(p) != p || p == "." || filepath.IsLocal(p) == false {
+		return fmt.Errorf("bad file path %q, it has to be a clean relative path inside the program's directory", p)
+	}
+	return nil
+}
+
+// add content to the end of the file at p, creating it if it's new
+func (w *Workspace) Append(p string, content string) error {
+	err := validateFilePath(p)
+	if err != nil {
+		return err
+	}
+	buf, ok := w.files[p]
+	if ok == false {
+		if len(w.files) == maxWorkspaceFiles {
+			return fmt.Errorf("too many files, programs can have at most %d", maxWorkspaceFiles)
+		}
+		buf = &bytes.Buffer{}
+		w.files[p] = buf
+		w.order = append(w.order, p)
+	}
+	buf.WriteString(content)
+	return nil
+}
+
+// add the content of a "file" message
+func (w *Workspace) AppendMessage(body string) error {
+	var msg FileMessage
+	err := json.Unmarshal([]byte(body), &msg)
+	if err != nil {
+		return fmt.Errorf("bad file message: %w", err)
+	}
+	return w.Append(msg.Path, msg.Content)
+}
+
+// whether the workspace has a file at p
+func (w *Workspace) Has(p string) bool {
+	_, ok := w.files[p]
+	return ok
+}
+
+// put prefix before the content of the file at p
+func (w *Workspace) Prepend(p string, prefix string) {
+	buf, ok := w.files[p]
+	if ok == false {
+		return
+	}
+	w.files[p] = bytes.NewBufferString(prefix + buf.String())
+}
+
+// write the files to dir, making directories as needed
+func (w *Workspace) WriteTo(dir string) error {
+	for _, p := range w.order {
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		err := os.MkdirAll(filepath.Dir(target), 0o700)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(target, w.files[p].Bytes(), 0o600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the files as "file" message bodies, in the order they were first sent
+func (w *Workspace) Messages() []FileMessage {
+	msgs := make([]FileMessage, 0, len(w.order))
+	for _, p := range w.order {
+		msgs = append(msgs, FileMessage{Path: p, Content: w.files[p].String()})
+	}
+	return msgs
+}
+
+// a description of the files for the logs
+func (w *Workspace) String() string {
+	var b strings.Builder
+	for _, p := range w.order {
+		fmt.Fprintf(&b, "%s:\n%s\n", p, w.files[p].String())
+	}
+	return b.String()
+}
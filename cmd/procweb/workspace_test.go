@@ -0,0 +1,150 @@
+package procweb
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateFilePath(t *testing.T) {
+	for _, p := range []string{"main.lua", "lib/player.lua", ".hidden", "data/levels.txt"} {
+		if err := validateFilePath(p); err != nil {
+			t.Errorf("%q should be allowed: %s", p, err)
+		}
+	}
+	for _, p := range []string{"", ".", "..", "../main.lua", "lib/../../main.lua", "/etc/passwd", "lib//player.lua", "lib/", "./main.lua", "lib\\player.lua", "a\x00b"} {
+		if validateFilePath(p) == nil {
+			t.Errorf("%q should be rejected", p)
+		}
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	w := NewWorkspace()
+	for _, f := range []FileMessage{
+		{Path: "main.lua", Content: "local player = "},
+		{Path: "lib/player.lua", Content: "return {}"},
+		{Path: "main.lua", Content: "require(\"lib.player\")"},
+	} {
+		body := fmt.Sprintf(`{"path": %q, "content": %q}`, f.Path, f.Content)
+		if err := w.AppendMessage(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.AppendMessage(`{"path": "../escape", "content": "x"}`) == nil {
+		t.Errorf("a file outside the workspace was accepted")
+	}
+	w.Prepend("main.lua", "-- prelude\n")
+
+	dir := t.TempDir()
+	err := w.WriteTo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{
+		"main.lua":       "-- prelude\nlocal player = require(\"lib.player\")",
+		"lib/player.lua": "return {}",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, p))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: want %q, got %q (%v)", p, want, got, err)
+		}
+	}
+
+	for i := len(w.order); i < maxWorkspaceFiles; i++ {
+		if err := w.Append(fmt.Sprintf("f%d", i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Append("one-too-many", "") == nil {
+		t.Errorf("expected a limit on the number of files")
+	}
+}
+
+func TestWithEntrypoint(t *testing.T) {
+	c := Languages["c"].WithEntrypoint("game.c")
+	if slices.Equal(c.Build, []string{"cc", "-O2", "-Wall", "-o", "main", "game.c"}) == false || c.FileName != "game.c" {
+		t.Errorf("bad build command %q", c.Build)
+	}
+	if strings.Contains(c.Prelude, `#line 1 "game.c"`) == false {
+		t.Errorf("the prelude should name the entrypoint: %q", c.Prelude)
+	}
+	if slices.Equal(Languages["c"].Build, []string{"cc", "-O2", "-Wall", "-o", "main", "main.c"}) == false {
+		t.Errorf("the language itself was changed: %q", Languages["c"].Build)
+	}
+	if python := Languages["python"].WithEntrypoint("game.py"); slices.Equal(python.Run, []string{"python3", "-u", "game.py"}) == false {
+		t.Errorf("bad run command %q", python.Run)
+	}
+}
+
+// a runner that reports the command it would run and the files it was given
+type workspaceRunner struct{}
+
+func (workspaceRunner) Run(ctx context.Context, cancel context.CancelFunc, job *Job) error {
+	defer close(job.Stdout)
+	defer close(job.Stderr)
+	report := func(s string) {
+		job.Stdout <- ProcMessage{Category: "stdout", Body: s}
+	}
+
+	report(fmt.Sprintf("run %s\n", strings.Join(job.Language.Command(), " ")))
+	return filepath.WalkDir(job.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(job.Dir, p)
+		report(fmt.Sprintf("%s: %s\n", rel, content))
+		return nil
+	})
+}
+
+func TestMultiFileProgram(t *testing.T) {
+	config := InstanceConfig{Runner: workspaceRunner{}, Language: Languages["python"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "file", Body: `{"path": "game.py", "content": "import player"}`},
+		{Category: "file", Body: `{"path": "player.py", "content": "name = "}`},
+		{Category: "file", Body: `{"path": "player.py", "content": "'bob'"}`},
+		{Category: "file", Body: `{"path": "data/levels.txt", "content": "1 2 3"}`},
+		{Category: "file", Body: `{"path": "../../etc/cron.d/evil", "content": "* * * * * root reboot"}`},
+		{Category: "entrypoint", Body: "game.py"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "run python3 -u game.py\ndata/levels.txt: 1 2 3\ngame.py: import player\nplayer.py: name = 'bob'\n"
+	if stdout := combineCategory(msgs, "stdout"); stdout.Body != want {
+		t.Errorf("want %q, got %q", want, stdout.Body)
+	}
+	if codes := protocolErrors(t, msgs); slices.Equal(codes, []string{ErrBadMessage}) == false {
+		t.Errorf("expected the escaping path to be rejected, got %q", codes)
+	}
+}
+
+func TestMissingEntrypoint(t *testing.T) {
+	config := InstanceConfig{Runner: workspaceRunner{}, Language: Languages["python"]}
+	msgs, err := runInstanceMessages(config, []ProcMessage{
+		{Category: "file", Body: `{"path": "main.py", "content": "print('hi')"}`},
+		{Category: "entrypoint", Body: "game.py"},
+		{Category: "EOF", Body: "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combineCategory(msgs, "stdout").Body != "" {
+		t.Errorf("the program shouldn't have run: %v", msgs)
+	}
+	if exit := exitStatus(t, msgs); exit.Code != -1 {
+		t.Errorf("expected the program to fail to start, got %+v", exit)
+	}
+}
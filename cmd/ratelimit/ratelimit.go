@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often idle clients are forgotten
+const sweepInterval = time.Minute
+
+// a Limiter gives each client a budget of events per minute, as a token bucket. A client
+// can use its whole budget at once, and it refills steadily over the minute.
+// A nil Limiter allows everything
+type Limiter struct {
+	perMinute int
+	now       func() time.Time
+
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	allowed   uint64
+	rejected  uint64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// a Limiter that allows each client perMinute events a minute
+func NewLimiter(perMinute int) *Limiter {
+	return &Limiter{
+		perMinute: perMinute,
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Stats is a snapshot of a Limiter, for monitoring
+type Stats struct {
+	PerMinute int    `json:"perMinute"`
+	Clients   int    `json:"clients"`
+	Allowed   uint64 `json:"allowed"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return Stats{PerMinute: l.perMinute, Clients: len(l.buckets), Allowed: l.allowed, Rejected: l.rejected}
+}
+
+// take one event from the client's budget. If it's used up, say how long until it isn't
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if ok == false {
+		b = &bucket{tokens: float64(l.perMinute), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		l.rejected++
+		wait := time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	l.allowed++
+	return true, 0
+}
+
+// tokens per second
+func (l *Limiter) rate() float64 {
+	return float64(l.perMinute) / 60
+}
+
+// the bucket's tokens as of now
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(l.perMinute), b.tokens+now.Sub(b.last).Seconds()*l.rate())
+}
+
+// forget clients whose buckets have refilled, since they'd start out full anyway.
+// Only call this with the lock held
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.perMinute) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// the address of the client making the request. Behind a reverse proxy every request comes
+// from the proxy, so with trustProxy the client is the one the proxy says it forwarded for
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		forwarded := r.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			// the proxy adds the address it saw last, anything before that is up to the client
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respond with 429 Too Many Requests, saying when to try again
+func Reject(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests, slow down", http.StatusTooManyRequests)
+}
+
+// turn away requests from clients that are over their budget
+func LimitWare(next http.Handler, limiter *Limiter, client func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := limiter.Allow(client(r))
+		if ok == false {
+			Reject(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
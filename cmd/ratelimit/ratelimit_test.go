@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); ok == false {
+			t.Fatalf("request %d was rejected", i)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter != 20*time.Second {
+		t.Errorf("expected to wait 20s, got %t %s", ok, retryAfter)
+	}
+	// other clients have their own budgets
+	if ok, _ := l.Allow("b"); ok == false {
+		t.Errorf("another client was rejected")
+	}
+
+	now = now.Add(20 * time.Second)
+	if ok, _ := l.Allow("a"); ok == false {
+		t.Errorf("the budget didn't refill")
+	}
+	if stats := l.Stats(); stats.Allowed != 5 || stats.Rejected != 1 || stats.Clients != 2 {
+		t.Errorf("bad stats %+v", stats)
+	}
+
+	// full buckets are forgotten
+	now = now.Add(2 * time.Minute)
+	l.Allow("c")
+	if stats := l.Stats(); stats.Clients != 1 {
+		t.Errorf("expected idle clients to be forgotten, got %+v", stats)
+	}
+
+	var none *Limiter
+	if ok, _ := none.Allow("a"); ok == false {
+		t.Errorf("no limiter should allow everything")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	if ip := ClientIP(r, false); ip != "10.0.0.1" {
+		t.Errorf("bad ip %q", ip)
+	}
+	if ip := ClientIP(r, true); ip != "5.6.7.8" {
+		t.Errorf("bad forwarded ip %q", ip)
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"time"
 
+	"gihub.com/scrmbld/OpenWorkbook/cmd/logging"
+	"gihub.com/scrmbld/OpenWorkbook/cmd/metrics"
 	"gihub.com/scrmbld/OpenWorkbook/cmd/procweb"
+	"gihub.com/scrmbld/OpenWorkbook/cmd/ratelimit"
 	"gihub.com/scrmbld/OpenWorkbook/views/pages"
 	"gihub.com/scrmbld/OpenWorkbook/views/pages/love"
 	"github.com/a-h/templ"
@@ -15,23 +22,233 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	// clients that ask for binary frames get them, everyone else gets JSON
+	Subprotocols: []string{procweb.BinarySubprotocol},
 }
 
 // create a new instance based on a request to a websocket
-func handleRun(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+func handleRun(runner procweb.Runner, limits procweb.LimitPolicy, admission *procweb.Admission, rates RateLimits, sessions *procweb.SessionStore, hub *procweb.Hub, recorder *procweb.Recorder, instanceMetrics *procweb.Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the client picks the exercise's limit overrides and terminal mode when it opens the
+		// socket. It says the language in its hello, but clients from before the handshake
+		// pick it here, and it's the language for clients that don't say
+		lang, err := procweb.LookupLanguage(r.URL.Query().Get("language"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		instanceLimits, err := limits.Resolve(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logging.Logger(r.Context()).Info("upgrade failed", "err", err)
+			return
+		}
+
+		client := rates.Client(r)
+		// the instance outlives the request's handler, but keeps its ID in the logs
+		procweb.NewInstance(ws, procweb.InstanceConfig{
+			Runner:    runner,
+			Language:  lang,
+			Limits:    instanceLimits,
+			PTY:       r.URL.Query().Get("pty") == "1",
+			Admission: admission,
+			Sessions:  sessions,
+			Hub:       hub,
+			Recorder:  recorder,
+			Metrics:   instanceMetrics,
+			Logger:    logging.Logger(r.Context()),
+			// only new programs use up the client's runs, coming back to one doesn't
+			AllowRun: func() (bool, time.Duration) { return rates.Runs.Allow(client) },
+		})
+	}
+}
+
+// join a running instance that's been shared, to watch it or pair on it
+func handleJoin(hub *procweb.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logging.Logger(r.Context()).Info("upgrade failed", "err", err)
+			return
+		}
+		procweb.JoinInstance(ws, hub, logging.Logger(r.Context()))
+	}
+}
+
+// the most a batch run's request body can be, files and stdin included
+const maxBatchRequest = 4 << 20
+
+// write v as a JSON response
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
 	if err != nil {
-		log.Print("upgrade: ", err)
+		logging.Logger(r.Context()).Warn("failed to write response", "err", err)
+	}
+}
+
+// run a program without a websocket. It either waits for the program to end and responds
+// with its output and exit status, or with async it responds with the job's ID straight
+// away, to be polled with handleBatchResult
+func handleBatchRun(runner procweb.Runner, limits procweb.LimitPolicy, admission *procweb.Admission, jobs *procweb.BatchJobs, recorder *procweb.Recorder, instanceMetrics *procweb.Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req procweb.BatchRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequest)).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+		lang, err := procweb.LookupLanguage(req.Language)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		overrides := url.Values{}
+		for k, v := range req.Limits {
+			overrides.Set(k, v)
+		}
+		runLimits, err := limits.Resolve(overrides)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		program, err := req.Program(lang)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log := logging.Logger(r.Context())
+		config := procweb.InstanceConfig{Runner: runner, Language: lang, Limits: runLimits, Admission: admission, Recorder: recorder, Metrics: instanceMetrics, Logger: log}
+
+		if req.Async {
+			id, err := jobs.Start(config, program, req.Stdin)
+			if err != nil {
+				batchError(w, log, err)
+				return
+			}
+			w.Header().Set("Location", "/api/run/"+id)
+			writeJSON(w, r, http.StatusAccepted, procweb.BatchResult{ID: id, Status: procweb.BatchRunning})
+			return
+		}
+		// a client that gives up on waiting takes its program with it
+		result, err := procweb.RunBatch(r.Context(), config, program, req.Stdin)
+		if err != nil {
+			batchError(w, log, err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// respond to a batch run that couldn't start. Protocol errors are the client's fault
+func batchError(w http.ResponseWriter, log *slog.Logger, err error) {
+	if errors.Is(err, procweb.ErrQueueFull) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	var perr *procweb.ProtocolError
+	if errors.As(err, &perr) {
+		http.Error(w, perr.Message, http.StatusBadRequest)
+		return
+	}
+	log.Error("failed to start batch run", "err", err)
+	http.Error(w, "failed to start program", http.StatusInternalServerError)
+}
 
-	procweb.NewInstance(ws)
+// report how an async batch run is going, and its result once it's done
+func handleBatchResult(jobs *procweb.BatchJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := jobs.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// the metadata of a recorded run, like its code and exit status
+func handleRecording(recorder *procweb.Recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, err := recorder.Metadata(r.PathValue("token"))
+		if err != nil {
+			http.Error(w, "no such recording", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, meta)
+	}
+}
+
+// a recorded run's terminal as an asciicast file, for asciinema and the like
+func handleRecordingCast(recorder *procweb.Recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, err := recorder.CastPath(r.PathValue("token"))
+		if err != nil {
+			http.Error(w, "no such recording", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		http.ServeFile(w, r, path)
+	}
+}
+
+// play a recorded run back over a websocket, like it was running again
+func handleReplay(recorder *procweb.Recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logging.Logger(r.Context()).Info("upgrade failed", "err", err)
+			return
+		}
+		procweb.ReplayRecording(ws, recorder, r.PathValue("token"), logging.Logger(r.Context()))
+	}
+}
+
+// report how many requests and runs have been turned away for going over their budgets
+func handleRateStats(requests *ratelimit.Limiter, runs *ratelimit.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, map[string]ratelimit.Stats{
+			"requests": requests.Stats(),
+			"runs":     runs.Stats(),
+		})
+	}
+}
+
+// report how many programs are running and waiting to run as JSON
+func handleQueueStats(admission *procweb.Admission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, admission.Stats())
+	}
+}
+
+// report the warm container pool's stats as JSON
+func handlePoolStats(pool *procweb.PoolRunner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, pool.Stats())
+	}
 }
 
 // add all of our routes to the mux in one place
 func AddRoutes(
 	mux *http.ServeMux,
-	logger *log.Logger,
+	logger *slog.Logger,
+	runner procweb.Runner,
+	limits procweb.LimitPolicy,
+	admission *procweb.Admission,
+	jobs *procweb.BatchJobs,
+	sessions *procweb.SessionStore,
+	hub *procweb.Hub,
+	recorder *procweb.Recorder,
+	rates RateLimits,
+	reg *metrics.Registry,
+	instanceMetrics *procweb.Metrics,
 ) {
 	mux.Handle("/index", templ.Handler(pages.Home()))
 	mux.Handle("/courses", templ.Handler(pages.Courses()))
@@ -43,5 +260,29 @@ func AddRoutes(
 	// static files
 	fs := http.FileServer(http.Dir("./dist"))
 	mux.Handle("/", fs)
-	mux.HandleFunc("/echo", handleRun)
+	// every route here goes through the requests limiter in NewServer. Runs are charged on top
+	// of that, but only for new programs, so resuming, joining and replaying aren't
+	mux.HandleFunc("/echo", handleRun(runner, limits, admission, rates, sessions, hub, recorder, instanceMetrics))
+	mux.Handle("POST /api/run", ratelimit.LimitWare(handleBatchRun(runner, limits, admission, jobs, recorder, instanceMetrics), rates.Runs, rates.Client))
+	mux.HandleFunc("GET /api/ratelimit", handleRateStats(rates.Requests, rates.Runs))
+	mux.HandleFunc("GET /api/run/{id}", handleBatchResult(jobs))
+	if hub != nil {
+		mux.HandleFunc("/join", handleJoin(hub))
+	}
+	if recorder != nil {
+		// recordings are looked up by the token only their run's client was given, not the
+		// run's ID, which viewers are told
+		mux.HandleFunc("GET /api/recording/{token}", handleRecording(recorder))
+		mux.HandleFunc("GET /api/recording/{token}/cast", handleRecordingCast(recorder))
+		mux.HandleFunc("/replay/{token}", handleReplay(recorder))
+	}
+	if admission != nil {
+		mux.HandleFunc("GET /api/queue", handleQueueStats(admission))
+	}
+	if pool, ok := runner.(*procweb.PoolRunner); ok {
+		mux.HandleFunc("GET /api/pool", handlePoolStats(pool))
+	}
+	if reg != nil {
+		mux.Handle("GET /metrics", reg.Handler())
+	}
 }
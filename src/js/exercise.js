@@ -25,8 +25,19 @@ async function highlightAsync(element) {
 	Prism.highlightElement(element);
 }
 
+// the version of the /echo protocol we speak, and the optional parts of it we understand
+const protocolVersion = 1;
+const protocolFeatures = ["resize", "signal", "exit", "seq", "files", "queue", "truncated", "base64", "resume"];
+
+// how many times we try to get back to a running program after the connection drops, and
+// how long we wait before the first try, in milliseconds. Each try waits a bit longer
+const maxResumeAttempts = 5;
+const resumeDelay = 500;
+
 // start the terminals and add button event listeners
 let terms = new Map();
+// the sockets of running programs, so the stop buttons can reach them
+let sockets = new Map();
 
 // function to initialize terminal elements, used in the script tag in the CodeExercise templ
 export function startTerm(probId) {
@@ -42,34 +53,275 @@ export function startTerm(probId) {
 	newTerm.write("Click 'Run' to run your code\r\n")
 }
 
+// the editors of an exercise, one for each of its files
+function codeAreas(probId) {
+	return document.querySelectorAll(`#codefiles${probId} .codearea`);
+}
+
 export function startCodeJar(probId) {
-	const jarElement = document.getElementById(`codearea${probId}`);
-	CodeJar(jarElement, highlightAsync);
+	const areas = codeAreas(probId);
+	for (const area of areas) {
+		CodeJar(area, highlightAsync);
+	}
+
+	// exercises with several files show one of them at a time
+	const tabs = document.querySelectorAll(`#codefiles${probId} .codetab`);
+	for (const tab of tabs) {
+		tab.addEventListener("click", () => {
+			const selected = Number(tab.dataset.tab);
+			areas.forEach((area, i) => area.classList.toggle("hidden", i !== selected));
+			tabs.forEach((other, i) => other.classList.toggle("opacity-60", i !== selected));
+		});
+	}
+}
+
+// the messages that send an exercise's program. A lone file without a path is the
+// language's usual file, and goes as plain code
+function programMessages(probId, entrypoint) {
+	const areas = codeAreas(probId);
+	if (areas.length === 1 && !areas[0].dataset.path) {
+		return splitByIndex(areas[0].textContent).map((s) => new ProcMessage("code", s));
+	}
+
+	let msgs = [];
+	for (const area of areas) {
+		const path = area.dataset.path;
+		const sections = splitByIndex(area.textContent);
+		// empty files still have to exist
+		if (sections.length === 0) {
+			sections.push("");
+		}
+		for (const s of sections) {
+			msgs.push(new ProcMessage("file", JSON.stringify({ path: path, content: s })));
+		}
+	}
+	if (entrypoint) {
+		msgs.push(new ProcMessage("entrypoint", entrypoint));
+	}
+	return msgs;
+}
+
+function sendSignal(ws, name) {
+	try {
+		sendProcMsg(ws, new ProcMessage("signal", name));
+	} catch (err) {
+		console.log(`error sending ${name}: ${err.message}`);
+	}
+}
+
+// a one line summary of an exit status, like "exited with status 1 (0.12s, 4.5 MiB)"
+function describeExit(status) {
+	let details = [`${status.wallTime.toFixed(2)}s`];
+	if (status.cpuTime) {
+		details.push(`${status.cpuTime.toFixed(2)}s CPU`);
+	}
+	if (status.peakMemory) {
+		details.push(`${(status.peakMemory / (1 << 20)).toFixed(1)} MiB`);
+	}
+	if (status.outputDropped) {
+		details.push(`${status.outputDropped} bytes of output not shown`);
+	}
+	return `${status.description} (${details.join(", ")})`;
+}
+
+// asks the program to stop, and kills it if it's asked again
+export function stopCode(e) {
+	const probId = e.target.id.replace("codestop", "");
+	const socket = sockets.get(probId);
+	if (socket === undefined || socket.readyState != socket.OPEN) {
+		return;
+	}
+	if (socket._stopping) {
+		sendSignal(socket, "SIGKILL");
+		return;
+	}
+	socket._stopping = true;
+	sendSignal(socket, "SIGTERM");
 }
 
 // sends our code to the server to run and connects to the instance that's created
 export function runCode(e) {
 	const probId = e.target.id.replace("coderun", "");
-	const codeText = document.getElementById("codearea" + probId).textContent;
-	console.log(codeText);
+	const language = e.target.dataset.language;
+	const limits = e.target.dataset.limits;
+	// on a terminal, the server does echo and line editing, so we pass keys and output through as they are
+	const pty = e.target.dataset.pty === "true";
+	const program = programMessages(probId, e.target.dataset.entrypoint);
 	const term = terms.get(probId);
 
 	const socketProtocol = window.location.protocol === 'https' ? 'wss:' : 'ws:';
-	const socketUrl = `${socketProtocol}//${window.location.host}/echo`;
-	const socket = new WebSocket(socketUrl)
+	// the language goes in the hello, the rest is picked when the socket opens
+	const query = [];
+	if (limits) {
+		query.push(limits);
+	}
+	if (pty) {
+		query.push("pty=1");
+	}
+	let socketUrl = `${socketProtocol}//${window.location.host}/echo`;
+	if (query.length !== 0) {
+		socketUrl += `?${query.join("&")}`;
+	}
+	// the socket is replaced if the connection drops while the program is still running
+	let socket;
+	let exited = false;
+	// what the server gave us to come back with, and the last message we've seen
+	let resumeToken = null;
+	let lastSeq = 0;
+	let resumeAttempts = 0;
+	// whether the program has been sent, so a new socket goes back to it instead
+	let started = false;
+
+	function connect() {
+		const ws = new WebSocket(socketUrl);
+		socket = ws;
+		sockets.set(probId, ws);
+		ws.onopen = started ? resume : start;
+		ws.onclose = (e) => {
+			console.log(`closed: ${e.code}`);
+			if (socket !== ws) {
+				return;
+			}
+			if (exited === false && resumeToken !== null && resumeAttempts < maxResumeAttempts) {
+				// the connection dropped, but the server keeps the program running for a while
+				resumeAttempts++;
+				term.write(`\r\n\x1b[2mConnection lost, reconnecting...\x1b[0m\r\n`);
+				setTimeout(connect, resumeDelay * resumeAttempts);
+				return;
+			}
+			sockets.delete(probId);
+			deactivateTerm();
+		};
+	}
+
+	// tell the server how big the terminal is, so the program can lay itself out for it
+	function sendSize(size) {
+		if (socket.readyState == socket.OPEN) {
+			const body = JSON.stringify({ rows: size.rows, cols: size.cols });
+			try {
+				sendProcMsg(socket, new ProcMessage("resize", body));
+			} catch (err) {
+				console.log(`error sending terminal size: ${err.message}`);
+			}
+		}
+	}
+
+	// whether the terminal's last line says we're waiting for a turn to run
+	let queued = false;
+	function onMessage(e) {
+		console.log(e.data);
+		const msg = JSON.parse(e.data);
+		if (msg.seq) {
+			lastSeq = msg.seq;
+		}
+		if (msg.category === "queued") {
+			// the server is busy, so the program waits its turn. Keep the position on one line
+			const position = JSON.parse(msg.body).position;
+			term.write(`\r\x1b[2K\x1b[2mWaiting for a turn to run (${position} in line)...\x1b[0m`);
+			queued = true;
+			return;
+		}
+		if (queued) {
+			term.write("\r\x1b[2K");
+			queued = false;
+		}
+		if (msg.category === "welcome") {
+			const welcome = JSON.parse(msg.body);
+			console.log(`instance ${welcome.instance}, protocol version ${welcome.version}, features ${welcome.features}`);
+			if (welcome.resume) {
+				resumeToken = welcome.resume;
+			}
+			resumeAttempts = 0;
+			return;
+		}
+		if (msg.category === "error") {
+			// the server turned us away, or we broke the protocol. Either way it isn't the student's program
+			const error = JSON.parse(msg.body);
+			console.error(`protocol error: ${error.code}: ${error.message}`);
+			if (error.code === "resume_failed") {
+				// the program's gone, so there's nothing to come back to
+				resumeToken = null;
+			}
+			term.write(`\r\n\x1b[33m${error.message}\x1b[0m\r\n`);
+			return;
+		}
+		if (msg.category === "truncated") {
+			// the program printed more than we'll show, the rest of its output is dropped
+			term.write(`\r\n\x1b[33m${msg.body}\x1b[0m\r\n`);
+			return;
+		}
+		if (msg.category === "limit") {
+			// the program was stopped for going over a resource limit
+			term.write(`\r\n\x1b[31m${msg.body}\x1b[0m\r\n`);
+			return;
+		}
+		if (msg.category === "exit") {
+			// how the program ended, the last message before the socket closes
+			exited = true;
+			term.write(`\r\n\x1b[2m${describeExit(JSON.parse(msg.body))}\x1b[0m\r\n`);
+			return;
+		}
+		if (msg.encoding === "base64") {
+			// output that isn't UTF-8. The terminal takes bytes as they are, otherwise the
+			// bad bytes show up as replacement characters
+			const bytes = Uint8Array.from(atob(msg.body), (c) => c.charCodeAt(0));
+			if (pty) {
+				term.write(bytes);
+				return;
+			}
+			msg.body = new TextDecoder().decode(bytes);
+		}
+		if (pty) {
+			term.write(msg.body);
+			return;
+		}
+		// NOTE: this could get expensive
+		const text = msg.body.replace(/\n/g, "\n\r");
+		if (msg.category === "stderr") {
+			// messages come in the order they were captured, so errors show up where they happened
+			term.write(`\x1b[91m${text}\x1b[0m`);
+			return;
+		}
+		term.write(text);
+	}
 
-	socket.onclose = (e) => {
-		console.log(`closed: ${e.code}`);
-		deactivateTerm();
-	};
+	// go back to the program after the connection dropped, and catch up on what we missed
+	function resume() {
+		socket.onmessage = onMessage;
+		const hello = {
+			version: protocolVersion,
+			features: pty ? [...protocolFeatures, "pty"] : protocolFeatures,
+			resume: resumeToken,
+			lastSeq: lastSeq,
+		};
+		try {
+			sendProcMsg(socket, new ProcMessage("hello", JSON.stringify(hello)));
+		} catch (err) {
+			console.log(`error sending hello: ${err.message}`);
+			return;
+		}
+		sendSize(term);
+	}
 
-	socket.onopen = () => {
+	function start() {
+		started = true;
+		const hello = {
+			version: protocolVersion,
+			features: pty ? [...protocolFeatures, "pty"] : protocolFeatures,
+			language: language,
+		};
+		try {
+			sendProcMsg(socket, new ProcMessage("hello", JSON.stringify(hello)));
+		} catch (err) {
+			console.log(`error sending hello: ${err.message}`);
+			return;
+		}
+		sendSize(term);
+		term.onResize(sendSize);
 
 		// send the code to the server before handing things over to the terminal
-		const codeSections = splitByIndex(codeText);
-		for (const s of codeSections) {
+		for (const msg of program) {
 			try {
-				let msg = new ProcMessage("code", s);
 				sendProcMsg(socket, msg);
 			} catch (err) {
 				console.log(`error sending code: ${err.message}`);
@@ -83,12 +335,7 @@ export function runCode(e) {
 			console.log(`error sending code EOF: ${err.message}`);
 		}
 
-		socket.onmessage = (e) => {
-			console.log(e.data);
-			msg = JSON.parse(e.data);
-			// NOTE: this could get expensive
-			term.write(msg.body.replace(/\n/g, "\n\r"));
-		}
+		socket.onmessage = onMessage;
 
 		function activateTerm() {
 			term.clear();
@@ -96,8 +343,31 @@ export function runCode(e) {
 			const newTheme = { background: "#000000" };
 			term.options.theme = { ...newTheme };
 
+			if (pty) {
+				// <C-d> and everything else go to the terminal, which knows what to do with them
+				term.onData((data) => {
+					if (socket.readyState == socket.OPEN) {
+						try {
+							sendProcMsg(socket, new ProcMessage("stdin", data));
+						} catch (err) {
+							console.log(err);
+						}
+					}
+				});
+				return;
+			}
+
 			term.attachCustomKeyEventHandler((e) => {
 				if (socket.readyState == socket.OPEN) {
+					// make <C-c> interrupt the program, like it would in a terminal
+					if (e.ctrlKey && e.key === 'c') {
+						if (e.type === "keydown") {
+							sendSignal(socket, "SIGINT");
+							term.write("^C");
+						}
+						return false;
+					}
+
 					// make <C-d> send EOF
 					if (e.ctrlKey && e.key === 'd') {
 						msg = new ProcMessage("EOF", "stdin");
@@ -134,7 +404,11 @@ export function runCode(e) {
 	}
 
 	function deactivateTerm() {
-		term.write("Done!\r\n");
+		if (exited === false) {
+			term.write("Done!\r\n");
+		}
 		term.blur();
 	}
+
+	connect();
 }
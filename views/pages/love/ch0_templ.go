@@ -56,7 +56,7 @@ func ch0() templ.Component {
 			if templ_7745c5c3_Err != nil {
 				return templ_7745c5c3_Err
 			}
-			templ_7745c5c3_Err = components.CodeExercise("").Render(ctx, templ_7745c5c3_Buffer)
+			templ_7745c5c3_Err = components.CodeExercise("luajit", "").Render(ctx, templ_7745c5c3_Buffer)
 			if templ_7745c5c3_Err != nil {
 				return templ_7745c5c3_Err
 			}